@@ -0,0 +1,155 @@
+package sshlocker
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the ssh_locker audit log.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	User     string    `json:"user,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	Result   string    `json:"result"`
+	PeerUID  *uint32   `json:"peerUid,omitempty"`
+	PeerPID  int32     `json:"peerPid,omitempty"`
+	// PeerCN is the certificate common name of agent connections.
+	PeerCN   string `json:"peerCn,omitempty"`
+	RemoteIP string `json:"remoteIp,omitempty"`
+	AuthUser string `json:"authUser,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Client   string `json:"client,omitempty"`
+	FailOpen bool   `json:"failOpen,omitempty"`
+	// ApprovedBy lists the users that approved the request.
+	ApprovedBy []string `json:"approvedBy,omitempty"`
+	// TokenID is the unlock token the request was made with.
+	TokenID string `json:"tokenId,omitempty"`
+	// Prev and Hash chain the entries together when hash chaining is enabled:
+	// Hash is the SHA-256 of the entry encoded with Hash left empty.
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLog appends entries to a JSON lines file.
+type AuditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	chain    bool
+	lastHash string
+}
+
+// OpenAuditLog opens path for appending. With chain set every entry records
+// the hash of its predecessor, so edits and deletions can be detected.
+func OpenAuditLog(path string, chain bool) (*AuditLog, error) {
+	a := &AuditLog{chain: chain}
+	if chain {
+		entries, err := ReadAuditLog(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for i := len(entries) - 1; i >= 0 && a.lastHash == ""; i-- {
+			a.lastHash = entries[i].Hash
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a.file = f
+	return a, nil
+}
+
+// Append stamps and writes e, syncing it to disk.
+func (a *AuditLog) Append(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Time = time.Now().UTC()
+	if a.chain {
+		e.Prev = a.lastHash
+		e.Hash = e.computeHash()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	a.lastHash = e.Hash
+	return nil
+}
+
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// ReadAuditLog reads every entry of the audit log at path.
+func ReadAuditLog(path string) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readAuditEntries(f)
+}
+
+func readAuditEntries(r io.Reader) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// AuditChainStart returns the index of the first chained entry of entries,
+// or len(entries) if there is none. Entries written before hash chaining was
+// enabled come before it.
+func AuditChainStart(entries []AuditEntry) int {
+	for i, e := range entries {
+		if e.Hash != "" {
+			return i
+		}
+	}
+	return len(entries)
+}
+
+// VerifyAuditChain checks the hash chain of entries from its start and
+// returns the index of the first entry that doesn't match, or -1 when the
+// chain is intact.
+func VerifyAuditChain(entries []AuditEntry) int {
+	prev := ""
+	for i := AuditChainStart(entries); i < len(entries); i++ {
+		e := entries[i]
+		if e.Prev != prev || e.Hash != e.computeHash() {
+			return i
+		}
+		prev = e.Hash
+	}
+	return -1
+}
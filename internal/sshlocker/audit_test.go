@@ -0,0 +1,84 @@
+package sshlocker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAuditLog appends one entry per element of chained, opening the log
+// with hash chaining as given, and returns what was written.
+func writeAuditLog(t *testing.T, chained ...bool) []AuditEntry {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i, chain := range chained {
+		a, err := OpenAuditLog(path, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Append(AuditEntry{Event: "unlock", User: "alice", Result: "ok", PeerPID: int32(i)}); err != nil {
+			t.Fatal(err)
+		}
+		a.Close()
+	}
+	entries, err := ReadAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		chained []bool
+		tamper  func(entries []AuditEntry) []AuditEntry
+		start   int
+		broken  int
+	}{
+		{"intact", []bool{true, true, true}, nil, 0, -1},
+		{"chained later", []bool{false, false, true, true}, nil, 2, -1},
+		{"edited", []bool{true, true, true}, func(e []AuditEntry) []AuditEntry { e[1].User = "mallory"; return e }, 0, 1},
+		{"deleted", []bool{true, true, true}, func(e []AuditEntry) []AuditEntry { return append(e[:1], e[2:]...) }, 0, 1},
+		{"head deleted", []bool{true, true, true}, func(e []AuditEntry) []AuditEntry { return e[1:] }, 0, 0},
+		{"edited after unchained start", []bool{false, true, true}, func(e []AuditEntry) []AuditEntry { e[2].Result = "denied"; return e }, 1, 2},
+		// Stripping the hash of an entry doesn't take it out of the chain
+		{"hash stripped", []bool{true, true, true}, func(e []AuditEntry) []AuditEntry { e[1].Hash = ""; return e }, 0, 1},
+		{"chaining paused", []bool{true, false, true}, nil, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := writeAuditLog(t, tt.chained...)
+			if tt.tamper != nil {
+				entries = tt.tamper(entries)
+			}
+			if got := AuditChainStart(entries); got != tt.start {
+				t.Errorf("AuditChainStart = %d, want %d", got, tt.start)
+			}
+			if got := VerifyAuditChain(entries); got != tt.broken {
+				t.Errorf("VerifyAuditChain = %d, want %d", got, tt.broken)
+			}
+		})
+	}
+}
+
+func TestVerifyAuditChainEmpty(t *testing.T) {
+	if got := VerifyAuditChain(nil); got != -1 {
+		t.Errorf("VerifyAuditChain = %d, want -1", got)
+	}
+}
+
+func TestOpenAuditLogResumesChain(t *testing.T) {
+	// Reopening with chaining continues from the last hashed entry, even
+	// when entries written without chaining follow it
+	entries := writeAuditLog(t, true, false, true)
+	if entries[2].Prev != entries[0].Hash {
+		t.Errorf("prev = %q, want the hash of the last chained entry %q", entries[2].Prev, entries[0].Hash)
+	}
+}
+
+func TestReadAuditLogMissing(t *testing.T) {
+	if _, err := ReadAuditLog(filepath.Join(t.TempDir(), "missing.log")); !os.IsNotExist(err) {
+		t.Errorf("ReadAuditLog = %v, want a not exist error", err)
+	}
+}
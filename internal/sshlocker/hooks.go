@@ -0,0 +1,202 @@
+package sshlocker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	HookExec    = "exec"
+	HookWebhook = "webhook"
+	HookSyslog  = "syslog"
+
+	// SignatureHeader carries the hex HMAC-SHA256 of a webhook body.
+	SignatureHeader = "X-SSH-Locker-Signature"
+
+	defaultHookTimeout = 10 * time.Second
+)
+
+// HookConfig describes a notification target fired on state changes.
+type HookConfig struct {
+	Type string `json:"type"`
+	// Events limits the hook to these events; empty means every event.
+	Events  []string `json:"events,omitempty"`
+	Command string   `json:"command,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	Secret  string   `json:"secret,omitempty"`
+	Tag     string   `json:"tag,omitempty"`
+	Timeout string   `json:"timeout,omitempty"`
+}
+
+// Event is the payload handed to hooks.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Host     string    `json:"host"`
+	User     string    `json:"user,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	RemoteIP string    `json:"remoteIp,omitempty"`
+	AuthUser string    `json:"authUser,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	FailOpen bool      `json:"failOpen,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// RequestID identifies a request waiting for approval.
+	RequestID  string   `json:"requestId,omitempty"`
+	ApprovedBy []string `json:"approvedBy,omitempty"`
+	TokenID    string   `json:"tokenId,omitempty"`
+}
+
+type hook struct {
+	HookConfig
+	timeout time.Duration
+	syslog  *syslog.Writer
+}
+
+// Notifier fires the configured hooks asynchronously.
+type Notifier struct {
+	hooks    []*hook
+	host     string
+	inflight sync.WaitGroup
+}
+
+// NewNotifier validates the hook configs and connects to syslog if needed.
+func NewNotifier(configs []HookConfig) (*Notifier, error) {
+	n := &Notifier{}
+	n.host, _ = os.Hostname()
+	for i, c := range configs {
+		h := &hook{HookConfig: c, timeout: defaultHookTimeout}
+		if c.Timeout != "" {
+			d, err := time.ParseDuration(c.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("hook %d: invalid timeout: %w", i, err)
+			}
+			h.timeout = d
+		}
+		switch c.Type {
+		case HookExec:
+			if c.Command == "" {
+				return nil, fmt.Errorf("hook %d: missing command", i)
+			}
+		case HookWebhook:
+			if c.URL == "" {
+				return nil, fmt.Errorf("hook %d: missing url", i)
+			}
+		case HookSyslog:
+			tag := c.Tag
+			if tag == "" {
+				tag = "ssh_locker"
+			}
+			w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_NOTICE, tag)
+			if err != nil {
+				return nil, fmt.Errorf("hook %d: %w", i, err)
+			}
+			h.syslog = w
+		default:
+			return nil, fmt.Errorf("hook %d: unknown type %q", i, c.Type)
+		}
+		n.hooks = append(n.hooks, h)
+	}
+	return n, nil
+}
+
+// Notify stamps e and fires every hook subscribed to its event. Host
+// defaults to the local hostname.
+func (n *Notifier) Notify(e Event) {
+	if n == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	if e.Host == "" {
+		e.Host = n.host
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Can't encode event: %v", err)
+		return
+	}
+	for _, h := range n.hooks {
+		if len(h.Events) > 0 && !slices.Contains(h.Events, e.Event) {
+			continue
+		}
+		n.inflight.Add(1)
+		go func(h *hook) {
+			defer n.inflight.Done()
+			if err := h.fire(e, payload); err != nil {
+				log.Printf("%s hook for %s failed: %v", h.Type, e.Event, err)
+			}
+		}(h)
+	}
+}
+
+// Close waits for the hooks still running, bounded by their timeouts, and
+// releases the syslog connections.
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	n.inflight.Wait()
+	for _, h := range n.hooks {
+		if h.syslog != nil {
+			h.syslog.Close()
+		}
+	}
+}
+
+func (h *hook) fire(e Event, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	switch h.Type {
+	case HookExec:
+		cmd := exec.CommandContext(ctx, h.Command)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Env = append(os.Environ(),
+			"SSH_LOCKER_EVENT="+e.Event,
+			"SSH_LOCKER_USER="+e.User,
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+	case HookWebhook:
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if h.Secret != "" {
+			req.Header.Set(SignatureHeader, "sha256="+Sign(h.Secret, payload))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook returned %s", resp.Status)
+		}
+	case HookSyslog:
+		return h.syslog.Notice(string(payload))
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of payload, as sent in SignatureHeader.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
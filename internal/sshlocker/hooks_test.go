@@ -0,0 +1,96 @@
+package sshlocker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// webhookRequest is a request received by the test webhook.
+type webhookRequest struct {
+	signature string
+	body      []byte
+}
+
+func newTestWebhook(t *testing.T) (*httptest.Server, func() []webhookRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var received []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, webhookRequest{signature: r.Header.Get(SignatureHeader), body: body})
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	srv, received := newTestWebhook(t)
+	n, err := NewNotifier([]HookConfig{{Type: HookWebhook, URL: srv.URL, Secret: "s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(Event{Event: "unlock", User: "alice", Host: "web1"})
+	n.Close()
+
+	got := received()
+	if len(got) != 1 {
+		t.Fatalf("received %d requests, want 1", len(got))
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(got[0].body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); got[0].signature != want {
+		t.Errorf("signature = %q, want %q", got[0].signature, want)
+	}
+	var e Event
+	if err := json.Unmarshal(got[0].body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Event != "unlock" || e.User != "alice" || e.Host != "web1" || e.Time.IsZero() {
+		t.Errorf("payload = %+v", e)
+	}
+}
+
+func TestWebhookUnsigned(t *testing.T) {
+	srv, received := newTestWebhook(t)
+	n, err := NewNotifier([]HookConfig{{Type: HookWebhook, URL: srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(Event{Event: "lock"})
+	n.Close()
+	if got := received(); len(got) != 1 || got[0].signature != "" {
+		t.Errorf("received %+v, want one request without a signature", got)
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	srv, received := newTestWebhook(t)
+	n, err := NewNotifier([]HookConfig{{Type: HookWebhook, URL: srv.URL, Events: []string{"unlock"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(Event{Event: "lock"})
+	n.Notify(Event{Event: "unlock"})
+	n.Close()
+	got := received()
+	if len(got) != 1 {
+		t.Fatalf("received %d requests, want 1", len(got))
+	}
+	var e Event
+	if err := json.Unmarshal(got[0].body, &e); err != nil || e.Event != "unlock" {
+		t.Errorf("event = %+v, %v, want unlock", e, err)
+	}
+}
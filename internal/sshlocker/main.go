@@ -0,0 +1,165 @@
+package sshlocker
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultSocketPath is the unix socket the ssh_locker daemon listens on by default.
+const DefaultSocketPath = "/var/run/ssh_locker.sock"
+
+// dialTimeout bounds connecting to a daemon and waiting for its reply.
+const dialTimeout = 30 * time.Second
+
+// Agent is how a client reaches an ssh_locker daemon: its unix socket (local
+// or forwarded over SSH), or its mTLS agent listener over TCP.
+type Agent struct {
+	// Network is "unix" or "tcp".
+	Network string
+	Address string
+	// TLS is used for tcp agents and must carry the client certificate.
+	TLS *tls.Config
+}
+
+func (a Agent) dial() (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if a.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, a.Network, a.Address, a.TLS)
+	} else {
+		conn, err = dialer.Dial(a.Network, a.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial error: %w", err)
+	}
+	return conn, nil
+}
+
+// Send sends a single command line to the daemon and returns its reply.
+func (a Agent) Send(cmd string) (string, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+		return "", fmt.Errorf("write error: %w", err)
+	}
+
+	resp, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("read error: %w", err)
+	}
+	return strings.TrimSpace(resp), nil
+}
+
+// SendRequest sends a structured request to the daemon and returns its reply.
+func (a Agent) SendRequest(req Request) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	return a.Send(string(data))
+}
+
+// Watch sends a watch request and calls fn with the reply and then every
+// event line the daemon streams, until fn or the connection fails.
+func (a Agent) Watch(req Request, fn func(line string) error) error {
+	conn, err := a.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", data); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if err := fn(strings.TrimSpace(scanner.Text())); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read error: %w", err)
+	}
+	return fmt.Errorf("connection closed by daemon")
+}
+
+// SendCommand sends a single command line to the ssh_locker daemon and returns its reply.
+func SendCommand(socketPath, cmd string) (string, error) {
+	return Agent{Network: "unix", Address: socketPath}.Send(cmd)
+}
+
+// Request is the structured form of a daemon command. Lines starting with
+// '{' are decoded as a Request; the remaining fields describe who asked for
+// it and are recorded in the audit log.
+type Request struct {
+	Command  string `json:"command"`
+	User     string `json:"user,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	RemoteIP string `json:"remoteIp,omitempty"`
+	// AuthUser is the user that passed the second factor (e.g. Duo).
+	AuthUser string `json:"authUser,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// Code is the recovery code of a recover command. It is never logged.
+	Code string `json:"code,omitempty"`
+	// Client is the API client of ssh_locker_web that made the request.
+	Client string `json:"client,omitempty"`
+	// FailOpen marks requests let through without the second factor
+	// because its backend was down.
+	FailOpen bool `json:"failOpen,omitempty"`
+	// Host is the daemon the request was approved for. A daemon refuses
+	// requests addressed to another host.
+	Host string `json:"host,omitempty"`
+	// ApprovedBy lists the users that approved the request, when a second
+	// person's approval was required.
+	ApprovedBy []string `json:"approvedBy,omitempty"`
+	// TokenID identifies the ssh_locker_web unlock token the request was
+	// made with.
+	TokenID string `json:"tokenId,omitempty"`
+	// JSON asks for a Reply instead of a text line.
+	JSON bool `json:"json,omitempty"`
+}
+
+// Reply statuses.
+const (
+	ReplyOK     = "ok"
+	ReplyError  = "error"
+	ReplyDenied = "denied"
+)
+
+// Reply is the answer to a request with JSON set. Users holds the state of
+// the users the command applied to.
+type Reply struct {
+	Status  string       `json:"status"`
+	Message string       `json:"message"`
+	Users   []UserStatus `json:"users,omitempty"`
+}
+
+// UserStatus is the lock state of a managed user.
+type UserStatus struct {
+	User     string `json:"user"`
+	Unlocked bool   `json:"unlocked"`
+	// Remaining and Deadline are set while an auto-lock is pending.
+	Remaining string     `json:"remaining,omitempty"`
+	Deadline  *time.Time `json:"deadline,omitempty"`
+}
+
+// SendRequest sends a structured request to the ssh_locker daemon and returns its reply.
+func SendRequest(socketPath string, req Request) (string, error) {
+	return Agent{Network: "unix", Address: socketPath}.SendRequest(req)
+}
@@ -0,0 +1,27 @@
+package sshlocker
+
+import (
+	"net"
+	"os"
+)
+
+// SdNotify sends state, e.g. "READY=1" or "STOPPING=1", to the systemd
+// notification socket. It does nothing unless the service runs with
+// Type=notify.
+func SdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
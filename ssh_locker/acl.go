@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// handshakeTimeout bounds the TLS handshake of agent connections, so a
+// client that never completes it doesn't hold a connection open.
+const handshakeTimeout = 10 * time.Second
+
+// peerCred identifies the process on the other end of a socket connection.
+type peerCred struct {
+	pid  int32
+	uid  uint32
+	gid  uint32
+	gids []uint32
+	// cn is the client certificate common name of agent connections,
+	// which have no uid.
+	cn string
+}
+
+func (p peerCred) String() string {
+	if p.cn != "" {
+		return "cn=" + p.cn
+	}
+	return fmt.Sprintf("pid=%d uid=%d gid=%d", p.pid, p.uid, p.gid)
+}
+
+// ACLRule allows the listed commands to peers matching any of the uids,
+// gids, users, groups or, for agent connections, certificate common names.
+// A rule without any of them matches every peer. The "attest" command
+// marks peers, i.e. ssh_locker_web, whose reports of the second factor and
+// approvals are believed.
+type ACLRule struct {
+	UIDs        []uint32 `json:"uids,omitempty"`
+	GIDs        []uint32 `json:"gids,omitempty"`
+	Users       []string `json:"users,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+	CommonNames []string `json:"commonNames,omitempty"`
+	Commands    []string `json:"commands"`
+}
+
+// resolve adds the ids of the named users and groups to the rule.
+func (r *ACLRule) resolve() error {
+	for _, name := range r.Users {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return err
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		r.UIDs = append(r.UIDs, uint32(uid))
+	}
+	for _, name := range r.Groups {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return err
+		}
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		r.GIDs = append(r.GIDs, uint32(gid))
+	}
+	r.Users, r.Groups = nil, nil
+	if len(r.Commands) == 0 {
+		return fmt.Errorf("no commands")
+	}
+	return nil
+}
+
+func (r ACLRule) matches(p peerCred) bool {
+	if len(r.UIDs) == 0 && len(r.GIDs) == 0 && len(r.CommonNames) == 0 {
+		return true
+	}
+	if p.cn != "" {
+		return slices.Contains(r.CommonNames, p.cn)
+	}
+	if slices.Contains(r.UIDs, p.uid) {
+		return true
+	}
+	for _, gid := range p.gids {
+		if slices.Contains(r.GIDs, gid) {
+			return true
+		}
+	}
+	return false
+}
+
+// attestCommand is the ACL command of peers that may attest requests.
+const attestCommand = "attest"
+
+// unprivilegedCommands are the commands every local user may run when no
+// ACL is configured.
+var unprivilegedCommands = []string{"lock", "status", "list"}
+
+// allowed reports whether the peer may run cmd. Without an ACL, root, the
+// daemon's own user and agent peers, whose certificates the client CA
+// vouches for, may run every command; other users only the unprivileged
+// ones.
+func allowed(acl []ACLRule, p peerCred, cmd string) bool {
+	if len(acl) == 0 {
+		return p.cn != "" || p.uid == 0 || p.uid == uint32(os.Getuid()) || slices.Contains(unprivilegedCommands, cmd)
+	}
+	for _, r := range acl {
+		if r.matches(p) && (slices.Contains(r.Commands, cmd) || slices.Contains(r.Commands, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// attests reports whether the peer's reports of the second factor and
+// approvals are believed.
+func attests(acl []ACLRule, p peerCred) bool {
+	return allowed(acl, p, attestCommand)
+}
+
+// getPeerCred reads SO_PEERCRED from a unix socket connection and looks up
+// the peer's supplementary groups. Agent connections are identified by their
+// verified client certificate, once the handshake finishes within
+// handshakeTimeout.
+func getPeerCred(conn net.Conn) (peerCred, error) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			return peerCred{}, err
+		}
+		clearDeadline(tc)
+		certs := tc.ConnectionState().PeerCertificates
+		if len(certs) == 0 || certs[0].Subject.CommonName == "" {
+			return peerCred{}, fmt.Errorf("no client certificate common name")
+		}
+		return peerCred{cn: certs[0].Subject.CommonName}, nil
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return peerCred{}, fmt.Errorf("not a unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return peerCred{}, err
+	}
+	p := peerCred{pid: cred.Pid, uid: cred.Uid, gid: cred.Gid, gids: []uint32{cred.Gid}}
+	if u, err := user.LookupId(strconv.FormatUint(uint64(cred.Uid), 10)); err == nil {
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if gid, err := strconv.ParseUint(id, 10, 32); err == nil && uint32(gid) != cred.Gid {
+					p.gids = append(p.gids, uint32(gid))
+				}
+			}
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+// AgentConfig enables the mTLS listener a remote ssh_locker_web connects to.
+// Peers must present a certificate signed by ClientCA; ACL rules match them
+// by the certificate's common name.
+type AgentConfig struct {
+	Listen   string `json:"listen"`
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"clientCA"`
+	// Name is the host name requests must be addressed to. It defaults to
+	// the system hostname.
+	Name string `json:"name,omitempty"`
+}
+
+// hostName is the name of this host in an ssh_locker_web registry. Requests
+// approved for another host are refused.
+var hostName string
+
+func setHostName() {
+	if config.Agent != nil && config.Agent.Name != "" {
+		hostName = config.Agent.Name
+		return
+	}
+	hostName, _ = os.Hostname()
+}
+
+func agentTLSConfig(cfg AgentConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("can't load certificate: %w", err)
+	}
+	pool, err := sshlocker.LoadCertPool(cfg.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("can't load client CA: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// serveAgent starts the mTLS agent listener in the background.
+func serveAgent(cfg AgentConfig) error {
+	tlsConfig, err := agentTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	ln, err := tls.Listen("tcp", cfg.Listen, tlsConfig)
+	if err != nil {
+		return err
+	}
+	log.Printf("Agent listening on %s as host %s", cfg.Listen, hostName)
+	go serve(ln)
+	return nil
+}
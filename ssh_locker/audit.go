@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+// AuditConfig configures the append-only audit trail.
+type AuditConfig struct {
+	File      string `json:"file"`
+	HashChain bool   `json:"hashChain,omitempty"`
+}
+
+var auditLog *sshlocker.AuditLog
+
+func openAuditLog() error {
+	if config.Audit.File == "" {
+		return nil
+	}
+	a, err := sshlocker.OpenAuditLog(config.Audit.File, config.Audit.HashChain)
+	if err != nil {
+		return err
+	}
+	auditLog = a
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+// commands lists the commands understood by the daemon.
+var commands = []string{"lock", "unlock", "extend", "status", "list", "recover", "watch"}
+
+// formatRemaining renders a remaining duration rounded to whole seconds.
+func formatRemaining(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	return d.Round(time.Second).String()
+}
+
+func statusLine(username string) string {
+	if !isUnlocked(username) {
+		return "Locked"
+	}
+	if remaining, ok := remainingTime(username); ok {
+		return fmt.Sprintf("Unlocked. Will auto-lock in %s", formatRemaining(remaining))
+	}
+	return "Unlocked"
+}
+
+// parseDuration parses a requested unlock duration and enforces maxUnlock.
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive")
+	}
+	if d > maxUnlock {
+		return 0, fmt.Errorf("duration exceeds maximum of %v", maxUnlock)
+	}
+	return d, nil
+}
+
+// parseRequest decodes a JSON request line, or a text command of the form
+//
+//	lock [user] | unlock [duration] [user] | extend <duration> [user] | status [user] | list
+//	recover <code> [duration] [user] | watch
+func parseRequest(line string) (sshlocker.Request, error) {
+	var req sshlocker.Request
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			return req, fmt.Errorf("invalid request: %w", err)
+		}
+		req.Command = strings.ToLower(req.Command)
+		return req, nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return req, fmt.Errorf("empty command")
+	}
+	req.Command, fields = strings.ToLower(fields[0]), fields[1:]
+	switch req.Command {
+	case "recover":
+		req.Code, fields = argAt(fields, 0), fields[min(1, len(fields)):]
+		fallthrough
+	case "unlock":
+		// The duration is optional, so a lone argument that is not a
+		// duration is taken as the user name.
+		if len(fields) > 0 {
+			if _, err := time.ParseDuration(fields[0]); err == nil || len(fields) > 1 {
+				req.Duration, fields = fields[0], fields[1:]
+			}
+		}
+	case "extend":
+		if len(fields) > 0 {
+			req.Duration, fields = fields[0], fields[1:]
+		}
+	}
+	req.User = argAt(fields, 0)
+	return req, nil
+}
+
+// handleCommand runs a request line and returns the reply. ok reports
+// whether the command succeeded; for watch it means the events are to be
+// streamed next.
+func handleCommand(peer peerCred, line string) (req sshlocker.Request, resp string, ok bool) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	req, err := parseRequest(line)
+	if err != nil {
+		requestsTotal.WithLabelValues("invalid", "error").Inc()
+		return req, "Unknown command", false
+	}
+	resp, status := execCommand(peer, req)
+	if req.JSON {
+		return req, jsonReply(req, resp, status), status == sshlocker.ReplyOK
+	}
+	return req, resp, status == sshlocker.ReplyOK
+}
+
+func execCommand(peer peerCred, req sshlocker.Request) (string, string) {
+	label := req.Command
+	if !slices.Contains(commands, label) {
+		label = "unknown"
+	}
+	// Anyone can fill in these fields; only trusted peers are believed
+	if !attests(config.ACL, peer) && (req.AuthUser != "" || req.FailOpen || req.Client != "" || len(req.ApprovedBy) > 0 || req.TokenID != "") {
+		log.Printf("Ignoring the attestation of %s command from %s", req.Command, peer)
+		req.AuthUser, req.FailOpen, req.Client, req.ApprovedBy, req.TokenID = "", false, "", nil, ""
+	}
+	if !allowed(config.ACL, peer, req.Command) {
+		log.Printf("Denied %s command from %s", req.Command, peer)
+		requestsTotal.WithLabelValues(label, "denied").Inc()
+		recordEvent(req.Command, req, &peer, "permission denied")
+		return "Permission denied", sshlocker.ReplyDenied
+	}
+	if req.Host != "" && req.Host != hostName {
+		log.Printf("Refused %s command for host %s from %s", req.Command, req.Host, peer)
+		requestsTotal.WithLabelValues(label, "wrong_host").Inc()
+		recordEvent(req.Command, req, &peer, "wrong host "+req.Host)
+		return "Request failed: addressed to host " + req.Host, sshlocker.ReplyError
+	}
+	resp := runCommand(peer, req)
+	result := sshlocker.ReplyOK
+	if strings.Contains(resp, "failed:") || resp == "Unknown command" {
+		result = sshlocker.ReplyError
+	}
+	requestsTotal.WithLabelValues(label, result).Inc()
+	return resp, result
+}
+
+// jsonReply wraps resp in a sshlocker.Reply with the state of the users the
+// command applied to.
+func jsonReply(req sshlocker.Request, resp, status string) string {
+	reply := sshlocker.Reply{Status: status, Message: resp}
+	if status == sshlocker.ReplyOK {
+		switch req.Command {
+		case "list":
+			for _, u := range managedUsers {
+				reply.Users = append(reply.Users, userStatus(u))
+			}
+		case "lock", "unlock", "extend", "status", "recover":
+			if u, err := resolveUser(req.User); err == nil {
+				reply.Users = append(reply.Users, userStatus(u))
+			}
+		}
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return resp
+	}
+	return string(data)
+}
+
+func userStatus(username string) sshlocker.UserStatus {
+	st := sshlocker.UserStatus{User: username, Unlocked: isUnlocked(username)}
+	if remaining, ok := remainingTime(username); ok && st.Unlocked {
+		deadline := time.Now().Add(remaining).UTC().Truncate(time.Second)
+		st.Remaining, st.Deadline = formatRemaining(remaining), &deadline
+	}
+	return st
+}
+
+func runCommand(peer peerCred, req sshlocker.Request) string {
+	var err error
+	switch req.Command {
+	case "lock":
+		username, err := resolveUser(req.User)
+		if err != nil {
+			return "Lock failed: " + err.Error()
+		}
+		req.User = username
+		log.Printf("Received lock command for %s", username)
+		if err := lockUser(username); err != nil {
+			recordEvent("lock", req, &peer, err.Error())
+			return "Lock failed: " + err.Error()
+		}
+		recordEvent("lock", req, &peer, "ok")
+		return "Locked"
+	case "unlock":
+		d := autoLockTimeout
+		if req.Duration != "" {
+			if d, err = parseDuration(req.Duration); err != nil {
+				return "Unlock failed: " + err.Error()
+			}
+		}
+		username, err := resolveUser(req.User)
+		if err != nil {
+			return "Unlock failed: " + err.Error()
+		}
+		req.User, req.Duration = username, d.String()
+		if err := checkWindowPolicy(username, peer, req); err != nil {
+			recordEvent("unlock", req, &peer, err.Error())
+			return "Unlock failed: " + err.Error()
+		}
+		log.Printf("Received unlock command for %s (%v)", username, d)
+		if err := unlockUser(username, d); err != nil {
+			recordEvent("unlock", req, &peer, err.Error())
+			return "Unlock failed: " + err.Error()
+		}
+		recordEvent("unlock", req, &peer, "ok")
+		return fmt.Sprintf("Unlocked. Will auto-lock in %v", d)
+	case "recover":
+		return recoverUser(peer, req)
+	case "extend":
+		if req.Duration == "" {
+			return "Extend failed: missing duration"
+		}
+		d, err := parseDuration(req.Duration)
+		if err != nil {
+			return "Extend failed: " + err.Error()
+		}
+		username, err := resolveUser(req.User)
+		if err != nil {
+			return "Extend failed: " + err.Error()
+		}
+		req.User = username
+		if err := checkWindowPolicy(username, peer, req); err != nil {
+			recordEvent("extend", req, &peer, err.Error())
+			return "Extend failed: " + err.Error()
+		}
+		log.Printf("Received extend command for %s (%v)", username, d)
+		remaining, err := extendAutoLock(username, d)
+		if err != nil {
+			recordEvent("extend", req, &peer, err.Error())
+			return "Extend failed: " + err.Error()
+		}
+		recordEvent("extend", req, &peer, "ok")
+		return fmt.Sprintf("Unlocked. Will auto-lock in %s", formatRemaining(remaining))
+	case "status":
+		username, err := resolveUser(req.User)
+		if err != nil {
+			return "Status failed: " + err.Error()
+		}
+		return statusLine(username)
+	case "watch":
+		return "Watching"
+	case "list":
+		entries := make([]string, 0, len(managedUsers))
+		for _, u := range managedUsers {
+			entries = append(entries, u+": "+statusLine(u))
+		}
+		return strings.Join(entries, "; ")
+	default:
+		return "Unknown command"
+	}
+}
+
+func argAt(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
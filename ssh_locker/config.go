@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+var configFile = "/etc/ssh_locker/config.json"
+
+// Config holds the daemon settings that don't fit on the command line.
+type Config struct {
+	// Users, AutoLockTimeout and MaxUnlock are overridden by the -u, -t and
+	// -m flags.
+	Users           []string `json:"users,omitempty"`
+	AutoLockTimeout string   `json:"autoLockTimeout,omitempty"`
+	MaxUnlock       string   `json:"maxUnlock,omitempty"`
+
+	ACL   []ACLRule              `json:"acl,omitempty"`
+	Audit AuditConfig            `json:"audit,omitempty"`
+	Hooks []sshlocker.HookConfig `json:"hooks,omitempty"`
+	// MetricsAddr enables the Prometheus /metrics listener, e.g. ":9101".
+	MetricsAddr string `json:"metricsAddr,omitempty"`
+	// Agent enables remote management by ssh_locker_web over mTLS.
+	Agent *AgentConfig `json:"agent,omitempty"`
+	// Windows unlock users on a schedule.
+	Windows []WindowConfig `json:"windows,omitempty"`
+	// Recovery enables break-glass recovery codes.
+	Recovery *RecoveryConfig `json:"recovery,omitempty"`
+}
+
+var config Config
+
+// loadConfig reads and validates path. A missing file yields the zero config.
+func loadConfig(path string) (Config, error) {
+	cfg := Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("can't read config file: %w", err)
+	}
+	// A file shared with ssh_locker_web keeps our settings under "daemon".
+	var shared struct {
+		Daemon json.RawMessage `json:"daemon"`
+	}
+	if json.Unmarshal(data, &shared) == nil && len(shared.Daemon) > 0 {
+		data = shared.Daemon
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("can't decode config JSON: %w", err)
+	}
+	for i := range cfg.ACL {
+		if err := cfg.ACL[i].resolve(); err != nil {
+			return cfg, fmt.Errorf("acl rule %d: %w", i, err)
+		}
+	}
+	for i := range cfg.Windows {
+		if err := cfg.Windows[i].resolve(); err != nil {
+			return cfg, fmt.Errorf("window %d: %w", i, err)
+		}
+	}
+	if cfg.Recovery != nil && cfg.Recovery.File == "" {
+		return cfg, fmt.Errorf("recovery: file is required")
+	}
+	if a := cfg.Agent; a != nil && (a.Listen == "" || a.Cert == "" || a.Key == "" || a.ClientCA == "") {
+		return cfg, fmt.Errorf("agent: listen, cert, key and clientCA are required")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+// notifier is swapped on reload while auto-lock timers may be firing.
+var notifier atomic.Pointer[sshlocker.Notifier]
+
+// recordEvent writes an event to the audit log, fires the hooks and streams
+// it to watchers. peer is nil for events the daemon triggers itself. Failed
+// events are notified as "error" events.
+func recordEvent(event string, req sshlocker.Request, peer *peerCred, result string) {
+	e := sshlocker.Event{
+		Event:    event,
+		User:     req.User,
+		Duration: req.Duration,
+		RemoteIP: req.RemoteIP,
+		AuthUser: req.AuthUser,
+		Reason:   req.Reason,
+		Client:   req.Client,
+		FailOpen: req.FailOpen,
+
+		ApprovedBy: req.ApprovedBy,
+		TokenID:    req.TokenID,
+	}
+	if result != "ok" {
+		e.Event, e.Error = "error", event+": "+result
+	}
+	eventsTotal.WithLabelValues(e.Event).Inc()
+	notifier.Load().Notify(e)
+	publish(e)
+
+	if auditLog == nil {
+		return
+	}
+	entry := sshlocker.AuditEntry{
+		Event:    event,
+		User:     req.User,
+		Duration: req.Duration,
+		Result:   result,
+		RemoteIP: req.RemoteIP,
+		AuthUser: req.AuthUser,
+		Reason:   req.Reason,
+		Client:   req.Client,
+		FailOpen: req.FailOpen,
+
+		ApprovedBy: req.ApprovedBy,
+		TokenID:    req.TokenID,
+	}
+	if peer != nil && peer.cn != "" {
+		entry.PeerCN = peer.cn
+	} else if peer != nil {
+		uid := peer.uid
+		entry.PeerUID, entry.PeerPID = &uid, peer.pid
+	}
+	if err := auditLog.Append(entry); err != nil {
+		log.Printf("Can't write audit log: %v", err)
+	}
+}
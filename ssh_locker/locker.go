@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+const (
+	lockFileName = "authorized_keys.lock"
+	authKeysName = "authorized_keys"
+)
+
+// userState tracks the auto-lock timer of an unlocked user.
+type userState struct {
+	timer    *time.Timer
+	deadline time.Time
+	since    time.Time
+	// loggedIn is set once a login consumed the unlock.
+	loggedIn bool
+}
+
+var (
+	managedUsers []string
+	states       = map[string]*userState{}
+	statesLock   sync.Mutex
+)
+
+func getSSHDir(username string) (string, error) {
+	usr, err := user.Lookup(username)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, ".ssh"), nil
+}
+
+func currentUsername() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return usr.Username, nil
+}
+
+// resolveUser returns the managed user a command applies to, defaulting to
+// the first managed user when none is given.
+func resolveUser(username string) (string, error) {
+	if username == "" {
+		return managedUsers[0], nil
+	}
+	for _, u := range managedUsers {
+		if u == username {
+			return u, nil
+		}
+	}
+	return "", fmt.Errorf("user %s is not managed", username)
+}
+
+// isManaged reports whether username is a managed user. It is for callers
+// outside a command, which don't hold configLock.
+func isManaged(username string) bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return slices.Contains(managedUsers, username)
+}
+
+func lockFile(username string) error {
+	sshDir, err := getSSHDir(username)
+	if err != nil {
+		return err
+	}
+	authKeys := filepath.Join(sshDir, authKeysName)
+	lockFile := filepath.Join(sshDir, lockFileName)
+	if _, err := os.Stat(authKeys); err == nil {
+		return os.Rename(authKeys, lockFile)
+	}
+	return nil // Already locked
+}
+
+func unlockFile(username string) error {
+	sshDir, err := getSSHDir(username)
+	if err != nil {
+		return err
+	}
+	authKeys := filepath.Join(sshDir, authKeysName)
+	lockFile := filepath.Join(sshDir, lockFileName)
+	if _, err := os.Stat(lockFile); err == nil {
+		return os.Rename(lockFile, authKeys)
+	}
+	return nil // Already unlocked
+}
+
+func isUnlocked(username string) bool {
+	sshDir, err := getSSHDir(username)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(sshDir, authKeysName))
+	return err == nil
+}
+
+// lockUser locks the user's keys and cancels any pending auto-lock.
+func lockUser(username string) error {
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	if st, ok := states[username]; ok {
+		st.timer.Stop()
+		delete(states, username)
+		observeLocked(username, st)
+	}
+	saveStateLocked()
+	return lockFile(username)
+}
+
+// unlockUser unlocks the user's keys and (re)starts the auto-lock timer.
+// The deadline is persisted before the keys are touched, so a crash in
+// between can't leave the user unlocked without one.
+func unlockUser(username string, d time.Duration) error {
+	startAutoLock(username, d)
+	if err := unlockFile(username); err != nil {
+		lockUser(username)
+		return err
+	}
+	return nil
+}
+
+func startAutoLock(username string, d time.Duration) {
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	now := time.Now()
+	st := &userState{deadline: now.Add(d), since: now}
+	if prev, ok := states[username]; ok {
+		prev.timer.Stop()
+		st.since = prev.since
+	} else {
+		resetSessions(username)
+	}
+	st.timer = time.AfterFunc(d, func() {
+		statesLock.Lock()
+		defer statesLock.Unlock()
+		if states[username] != st {
+			return
+		}
+		delete(states, username)
+		observeLocked(username, st)
+		saveStateLocked()
+		log.Printf("Auto-locking %s", username)
+		req := sshlocker.Request{Command: "lock", User: username}
+		if err := lockFile(username); err != nil {
+			log.Printf("Auto-lock of %s failed: %v", username, err)
+			recordEvent("autolock", req, nil, err.Error())
+			return
+		}
+		recordEvent("autolock", req, nil, "ok")
+	})
+	states[username] = st
+	unlockedUsers.Set(float64(len(states)))
+	saveStateLocked()
+}
+
+// extendAutoLock pushes the auto-lock deadline of an unlocked user back by d,
+// without letting the remaining time exceed maxUnlock.
+func extendAutoLock(username string, d time.Duration) (time.Duration, error) {
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	st, ok := states[username]
+	if !ok {
+		return 0, fmt.Errorf("%s is not unlocked", username)
+	}
+	remaining := time.Until(st.deadline) + d
+	if remaining > maxUnlock {
+		return 0, fmt.Errorf("remaining time would exceed maximum of %v", maxUnlock)
+	}
+	if !st.timer.Stop() {
+		return 0, fmt.Errorf("%s is being locked", username)
+	}
+	st.deadline = st.deadline.Add(d)
+	st.timer.Reset(remaining)
+	saveStateLocked()
+	return remaining, nil
+}
+
+// remainingTime returns the time left before the user is auto-locked.
+func remainingTime(username string) (time.Duration, bool) {
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	st, ok := states[username]
+	if !ok {
+		return 0, false
+	}
+	return time.Until(st.deadline), true
+}
+
+// systemLock locks a user on the daemon's own initiative and audits it.
+func systemLock(username, event, reason string) {
+	req := sshlocker.Request{Command: "lock", User: username, Reason: reason}
+	if err := lockUser(username); err != nil {
+		log.Printf("Lock of %s failed: %v", username, err)
+		recordEvent(event, req, nil, err.Error())
+		return
+	}
+	recordEvent(event, req, nil, "ok")
+}
+
+// lockAll locks every managed user, auditing the ones that were unlocked.
+func lockAll(reason string) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	for _, u := range managedUsers {
+		if isUnlocked(u) {
+			systemLock(u, "lock", reason)
+		} else if err := lockUser(u); err != nil {
+			log.Printf("Lock of %s failed: %v", u, err)
+		}
+	}
+}
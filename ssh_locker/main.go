@@ -2,161 +2,158 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
-	"os/user"
-	"path/filepath"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"log"
-)
 
-// Change consts to vars so they can be set by flags
-var (
-	socketPath      = "/var/run/ssh_locker.sock"
-	autoLockTimeout = 5 * time.Minute
-	timer           *time.Timer
-	timerLock       sync.Mutex
+	"github.com/a13labs/systools/internal/sshlocker"
 )
 
 const (
-	lockFileName = "authorized_keys.lock"
-	authKeysName = "authorized_keys"
+	defaultAutoLockTimeout = 5 * time.Minute
+	defaultMaxUnlock       = 1 * time.Hour
 )
 
-func setupSignalHandler(ln net.Listener) {
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigCh
-		log.Printf("Received shutdown signal, shutting down...")
-		ln.Close()
-		os.Remove(socketPath)
-		lockFile()
-		os.Exit(0)
-	}()
-}
-
-func getSSHDir() (string, error) {
-	usr, err := user.Current()
-	if err != nil {
-		return "", err
-	}
-	return filepath.Join(usr.HomeDir, ".ssh"), nil
-}
-
-func lockFile() error {
-	sshDir, err := getSSHDir()
-	if err != nil {
-		return err
-	}
-	authKeys := filepath.Join(sshDir, authKeysName)
-	lockFile := filepath.Join(sshDir, lockFileName)
-	if _, err := os.Stat(authKeys); err == nil {
-		return os.Rename(authKeys, lockFile)
-	}
-	return nil // Already locked
-}
+// Change consts to vars so they can be set by flags
+var (
+	socketPath      = sshlocker.DefaultSocketPath
+	autoLockTimeout = defaultAutoLockTimeout
+	maxUnlock       = defaultMaxUnlock
+)
 
-func unlockFile() error {
-	sshDir, err := getSSHDir()
+func handleConn(conn net.Conn) {
+	defer conn.Close()
+	peer, err := getPeerCred(conn)
 	if err != nil {
-		return err
-	}
-	authKeys := filepath.Join(sshDir, authKeysName)
-	lockFile := filepath.Join(sshDir, lockFileName)
-	if _, err := os.Stat(lockFile); err == nil {
-		return os.Rename(lockFile, authKeys)
-	}
-	return nil // Already unlocked
-}
-
-func startAutoLock() {
-	timerLock.Lock()
-	defer timerLock.Unlock()
-	if timer != nil {
-		timer.Stop()
+		log.Printf("Can't read peer credentials: %v", err)
+		socketErrors.WithLabelValues("peercred").Inc()
+		return
 	}
-	timer = time.AfterFunc(autoLockTimeout, func() {
-		log.Printf("Auto-locking after %v", autoLockTimeout)
-		lockFile()
-	})
-}
-
-func handleCommand(cmd string) string {
-	switch strings.TrimSpace(strings.ToLower(cmd)) {
-	case "lock":
-		log.Printf("Received lock command")
-		if err := lockFile(); err != nil {
-			return "Lock failed: " + err.Error()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		req, resp, ok := handleCommand(peer, scanner.Text())
+		if _, err := conn.Write([]byte(resp + "\n")); err != nil {
+			socketErrors.WithLabelValues("write").Inc()
+			return
 		}
-		return "Locked"
-	case "unlock":
-		log.Printf("Received unlock command")
-		if err := unlockFile(); err != nil {
-			return "Unlock failed: " + err.Error()
+		if req.Command == "watch" && ok {
+			streamEvents(conn, scanner)
+			return
 		}
-		startAutoLock()
-		return fmt.Sprintf("Unlocked. Will auto-lock in %v", autoLockTimeout)
-	default:
-		return "Unknown command"
 	}
-}
-
-func handleConn(conn net.Conn) {
-	defer conn.Close()
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		resp := handleCommand(scanner.Text())
-		conn.Write([]byte(resp + "\n"))
+	if scanner.Err() != nil {
+		socketErrors.WithLabelValues("read").Inc()
 	}
 }
 
 func main() {
 	var (
-		socket  string
-		timeout string
+		socket string
+		codes  int
 	)
 	flag.StringVar(&socket, "s", socketPath, "Path to unix socket")
-	flag.StringVar(&timeout, "t", autoLockTimeout.String(), "Auto-lock timeout (e.g. 5m, 30s)")
+	flag.StringVar(&configFile, "c", configFile, "Path to the config file")
+	flag.StringVar(&flagTimeout, "t", autoLockTimeout.String(), "Auto-lock timeout (e.g. 5m, 30s)")
+	flag.StringVar(&flagMaximum, "m", maxUnlock.String(), "Maximum unlock duration a client may request")
+	flag.StringVar(&flagUsers, "u", "", "Comma-separated users to manage (default: current user)")
+	flag.StringVar(&stateFile, "f", stateFile, "Path to the state file (empty to disable persistence)")
+	flag.StringVar(&relockMode, "r", relockMode, "Relock mode: timer, login (after the first login) or session (after the last session ends)")
+	flag.StringVar(&authLog, "l", authLog, "sshd auth log to watch, or \"journal\" to follow the systemd journal")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "How long to wait for commands in flight on shutdown")
+	flag.IntVar(&codes, "recovery-codes", 0, "Replace the recovery codes with this many new ones, print them and exit")
 	flag.Parse()
+	recordFlags()
 
 	if socket != "" {
 		socketPath = socket
 	}
-	if timeout != "" {
-		if d, err := time.ParseDuration(timeout); err == nil {
-			autoLockTimeout = d
-		}
+	switch relockMode {
+	case relockTimer, relockLogin, relockSession:
+	default:
+		log.Printf("Invalid relock mode: %s", relockMode)
+		return
 	}
 	// configure logging to include timestamp
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		log.Printf("Config error: %v", err)
+		return
+	}
+	if codes > 0 {
+		if cfg.Recovery == nil {
+			log.Printf("Config error: no recovery file configured")
+			return
+		}
+		list, err := generateRecoveryCodes(cfg.Recovery.File, codes)
+		if err != nil {
+			log.Printf("Can't write recovery codes: %v", err)
+			return
+		}
+		for _, c := range list {
+			fmt.Println(c)
+		}
+		return
+	}
+	if err := applyConfig(cfg); err != nil {
+		log.Printf("Config error: %v", err)
+		return
+	}
+	setHostName()
+	if err := openAuditLog(); err != nil {
+		log.Printf("Can't open audit log: %v", err)
+		return
+	}
+
 	os.Remove(socketPath)
 	ln, err := net.Listen("unix", socketPath)
 	if err != nil {
 		log.Printf("Listen error: %v", err)
 		return
 	}
-	defer ln.Close()
+	// Every local user may connect; the ACL decides what they may run
 	os.Chmod(socketPath, 0666)
 
 	log.Printf("Listening on %s", socketPath)
-	log.Printf("Commands: lock, unlock")
-	log.Printf("Auto-lock timeout: %v", autoLockTimeout)
-	lockFile()
-	setupSignalHandler(ln)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			continue
+	log.Printf("Commands: %s", strings.Join(commands, ", "))
+	log.Printf("Managing users: %s", strings.Join(managedUsers, ", "))
+	log.Printf("Auto-lock timeout: %v (maximum %v)", autoLockTimeout, maxUnlock)
+	if len(config.ACL) == 0 {
+		log.Printf("No ACL configured, other local users may only run %s", strings.Join(unprivilegedCommands, ", "))
+	}
+	if relockMode != relockTimer {
+		log.Printf("Relocking on %s, watching %s", relockMode, authLog)
+	}
+	if config.MetricsAddr != "" {
+		serveMetrics(config.MetricsAddr)
+	}
+	if config.Agent != nil {
+		if err := serveAgent(*config.Agent); err != nil {
+			log.Printf("Agent error: %v", err)
+			return
 		}
-		go handleConn(conn)
 	}
+	countRecoveryCodes()
+	restoreState()
+	watchSessions()
+	watchWindows()
+	watchConfig()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go serve(ln)
+	configLock.RLock()
+	sshlocker.SdNotify("READY=1\nSTATUS=Managing " + strings.Join(managedUsers, ", "))
+	configLock.RUnlock()
+	<-ctx.Done()
+	log.Printf("Received shutdown signal, shutting down...")
+	shutdown()
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_requests_total",
+		Help: "Commands received on the socket, by command and result.",
+	}, []string{"command", "result"})
+	eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_events_total",
+		Help: "Lock state changes, by event.",
+	}, []string{"event"})
+	unlockedUsers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ssh_locker_unlocked_users",
+		Help: "Number of users currently unlocked.",
+	})
+	unlockedSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_unlocked_seconds_total",
+		Help: "Time users spent unlocked, in seconds.",
+	}, []string{"user"})
+	recoveryCodesLeft = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ssh_locker_recovery_codes_left",
+		Help: "Unused break-glass recovery codes.",
+	})
+	socketErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_socket_errors_total",
+		Help: "Errors on the command socket, by operation.",
+	}, []string{"op"})
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_config_reloads_total",
+		Help: "Config reloads, by result (ok or rejected).",
+	}, []string{"result"})
+)
+
+// observeLocked accounts for the time st was unlocked. The caller must hold
+// statesLock and have already removed st from states.
+func observeLocked(username string, st *userState) {
+	unlockedSeconds.WithLabelValues(username).Add(time.Since(st.since).Seconds())
+	unlockedUsers.Set(float64(len(states)))
+}
+
+// serveMetrics exposes /metrics on addr.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Printf("Serving metrics on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics listener error: %v", err)
+		}
+	}()
+}
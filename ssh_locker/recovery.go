@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+// recoveryFailDelay slows down guessing of recovery codes.
+const recoveryFailDelay = time.Second
+
+var errInvalidRecoveryCode = errors.New("invalid recovery code")
+
+// RecoveryConfig enables break-glass recovery codes, redeemed with the
+// recover command when the second factor or ssh_locker_web is unavailable.
+type RecoveryConfig struct {
+	// File holds the SHA-256 hashes of the codes, written by -recovery-codes.
+	File string `json:"file"`
+}
+
+// recoveryCode is a stored code. Used codes are kept for the record.
+type recoveryCode struct {
+	Hash string     `json:"hash"`
+	Used *time.Time `json:"used,omitempty"`
+	By   string     `json:"by,omitempty"`
+}
+
+type recoveryFile struct {
+	Created time.Time      `json:"created"`
+	Codes   []recoveryCode `json:"codes"`
+}
+
+var recoveryLock sync.Mutex
+
+// normalizeRecoveryCode ignores case, dashes and spaces.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadRecoveryFile(path string) (recoveryFile, error) {
+	var rf recoveryFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rf, err
+	}
+	err = json.Unmarshal(data, &rf)
+	return rf, err
+}
+
+func saveRecoveryFile(path string, rf recoveryFile) error {
+	data, err := json.MarshalIndent(rf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// generateRecoveryCodes replaces the codes in path with n new ones and
+// returns them. They are only shown once.
+func generateRecoveryCodes(path string, n int) ([]string, error) {
+	rf := recoveryFile{Created: time.Now().UTC()}
+	var codes []string
+	for range n {
+		buf := make([]byte, 10)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := base32.StdEncoding.EncodeToString(buf)
+		code := raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		codes = append(codes, code)
+		rf.Codes = append(rf.Codes, recoveryCode{Hash: hashRecoveryCode(code)})
+	}
+	recoveryLock.Lock()
+	defer recoveryLock.Unlock()
+	if err := saveRecoveryFile(path, rf); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// redeemRecoveryCode marks code as used by who and returns the number of
+// codes left. The file is written before the caller unlocks anything, so a
+// code can't be used twice. A wrong code is answered after recoveryFailDelay,
+// without holding up other redemptions.
+func redeemRecoveryCode(code, who string) (int, error) {
+	left, err := spendRecoveryCode(code, who)
+	if errors.Is(err, errInvalidRecoveryCode) {
+		time.Sleep(recoveryFailDelay)
+	}
+	return left, err
+}
+
+func spendRecoveryCode(code, who string) (int, error) {
+	if config.Recovery == nil {
+		return 0, fmt.Errorf("recovery codes are not configured")
+	}
+	recoveryLock.Lock()
+	defer recoveryLock.Unlock()
+	rf, err := loadRecoveryFile(config.Recovery.File)
+	if err != nil {
+		return 0, fmt.Errorf("can't read recovery codes: %w", err)
+	}
+	hash := []byte(hashRecoveryCode(code))
+	found, left := -1, 0
+	for i, c := range rf.Codes {
+		if c.Used != nil {
+			continue
+		}
+		left++
+		if subtle.ConstantTimeCompare(hash, []byte(c.Hash)) == 1 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return left, errInvalidRecoveryCode
+	}
+	now := time.Now().UTC()
+	rf.Codes[found].Used, rf.Codes[found].By = &now, who
+	if err := saveRecoveryFile(config.Recovery.File, rf); err != nil {
+		return left, fmt.Errorf("can't write recovery codes: %w", err)
+	}
+	recoveryCodesLeft.Set(float64(left - 1))
+	return left - 1, nil
+}
+
+// countRecoveryCodes logs and exports the number of unused codes at startup.
+func countRecoveryCodes() {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	if config.Recovery == nil {
+		return
+	}
+	rf, err := loadRecoveryFile(config.Recovery.File)
+	if err != nil {
+		log.Printf("Can't read recovery codes: %v", err)
+		return
+	}
+	left := 0
+	for _, c := range rf.Codes {
+		if c.Used == nil {
+			left++
+		}
+	}
+	recoveryCodesLeft.Set(float64(left))
+	log.Printf("%d recovery codes left in %s", left, config.Recovery.File)
+}
+
+// recoverUser unlocks a user with a recovery code. It bypasses the windows
+// and is always audited and notified as a recovery event.
+func recoverUser(peer peerCred, req sshlocker.Request) string {
+	if req.Code == "" {
+		return "Recovery failed: missing code"
+	}
+	d := autoLockTimeout
+	if req.Duration != "" {
+		var err error
+		if d, err = parseDuration(req.Duration); err != nil {
+			return "Recovery failed: " + err.Error()
+		}
+	}
+	username, err := resolveUser(req.User)
+	if err != nil {
+		return "Recovery failed: " + err.Error()
+	}
+	req.User, req.Duration = username, d.String()
+	who := peer.String()
+	if req.RemoteIP != "" {
+		who += " ip=" + req.RemoteIP
+	}
+
+	left, err := redeemRecoveryCode(req.Code, who)
+	if err != nil {
+		log.Printf("Recovery for %s by %s failed: %v", username, who, err)
+		recordEvent("recovery", req, &peer, err.Error())
+		return "Recovery failed: " + err.Error()
+	}
+	log.Printf("RECOVERY CODE USED to unlock %s by %s, %d codes left", username, who, left)
+	if err := unlockUser(username, d); err != nil {
+		// The code stays spent; say so, so it isn't mistaken for a wrong one
+		log.Printf("Recovery code used by %s but unlocking %s failed: %v", who, username, err)
+		recordEvent("recovery", req, &peer, "code used, unlock failed: "+err.Error())
+		return fmt.Sprintf("Recovery failed, the code was used up (%d left): %v", left, err)
+	}
+	recordEvent("recovery", req, &peer, "ok")
+	return fmt.Sprintf("Unlocked with a recovery code, %d left. Will auto-lock in %v", left, d)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRedeemRecoveryCode(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Recovery = &RecoveryConfig{File: t.TempDir() + "/codes.json"}
+	codes, err := generateRecoveryCodes(config.Recovery.File, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A wrong guess waits out the delay without blocking a good code
+	failed := make(chan error)
+	go func() {
+		_, err := redeemRecoveryCode("AAAA-AAAA-AAAA-AAAA", "guesser")
+		failed <- err
+	}()
+	time.Sleep(recoveryFailDelay / 10)
+	start := time.Now()
+	left, err := redeemRecoveryCode(codes[0], "alice")
+	if err != nil || left != 1 {
+		t.Fatalf("redeem = %d, %v, want 1 left", left, err)
+	}
+	if waited := time.Since(start); waited >= recoveryFailDelay/2 {
+		t.Errorf("good code waited %v behind a wrong one", waited)
+	}
+	if err := <-failed; !errors.Is(err, errInvalidRecoveryCode) {
+		t.Errorf("wrong code: %v", err)
+	}
+
+	if _, err := redeemRecoveryCode(codes[0], "alice"); !errors.Is(err, errInvalidRecoveryCode) {
+		t.Errorf("code used twice: %v", err)
+	}
+	if left, err := redeemRecoveryCode(codes[1], "bob"); err != nil || left != 0 {
+		t.Errorf("redeem = %d, %v, want 0 left", left, err)
+	}
+}
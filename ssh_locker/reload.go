@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+const configPollInterval = 5 * time.Second
+
+// configLock guards config and the settings derived from it (managedUsers,
+// autoLockTimeout and maxUnlock) against reloads.
+var configLock sync.RWMutex
+
+// Flags given on the command line take precedence over the config file.
+var (
+	flagsSet    = map[string]bool{}
+	flagUsers   string
+	flagTimeout string
+	flagMaximum string
+)
+
+func recordFlags() {
+	flag.Visit(func(f *flag.Flag) { flagsSet[f.Name] = true })
+}
+
+// settings are the values a flag or the config file may set.
+type settings struct {
+	users     []string
+	autoLock  time.Duration
+	maxUnlock time.Duration
+}
+
+func resolveSettings(cfg Config) (settings, error) {
+	s := settings{autoLock: defaultAutoLockTimeout, maxUnlock: defaultMaxUnlock}
+
+	users := strings.Join(cfg.Users, ",")
+	if flagsSet["u"] {
+		users = flagUsers
+	}
+	for _, u := range strings.Split(users, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			s.users = append(s.users, u)
+		}
+	}
+	if len(s.users) == 0 {
+		u, err := currentUsername()
+		if err != nil {
+			return s, fmt.Errorf("can't determine current user: %w", err)
+		}
+		s.users = []string{u}
+	}
+	for _, u := range s.users {
+		if _, err := getSSHDir(u); err != nil {
+			return s, fmt.Errorf("user %s: %w", u, err)
+		}
+	}
+
+	timeout, maximum := cfg.AutoLockTimeout, cfg.MaxUnlock
+	if flagsSet["t"] {
+		timeout = flagTimeout
+	}
+	if flagsSet["m"] {
+		maximum = flagMaximum
+	}
+	var err error
+	if timeout != "" {
+		if s.autoLock, err = time.ParseDuration(timeout); err != nil || s.autoLock <= 0 {
+			return s, fmt.Errorf("invalid auto-lock timeout %q", timeout)
+		}
+	}
+	if maximum != "" {
+		if s.maxUnlock, err = time.ParseDuration(maximum); err != nil || s.maxUnlock <= 0 {
+			return s, fmt.Errorf("invalid maximum unlock %q", maximum)
+		}
+	}
+	if s.autoLock > s.maxUnlock {
+		s.maxUnlock = s.autoLock
+	}
+
+	for _, w := range cfg.Windows {
+		for _, u := range w.Users {
+			if !slices.Contains(s.users, u) {
+				return s, fmt.Errorf("window %s: user %s is not managed", w.Name, u)
+			}
+		}
+	}
+	return s, nil
+}
+
+// applyConfig validates cfg and makes it current. Nothing changes if it is
+// invalid.
+func applyConfig(cfg Config) error {
+	s, err := resolveSettings(cfg)
+	if err != nil {
+		return err
+	}
+	n, err := sshlocker.NewNotifier(cfg.Hooks)
+	if err != nil {
+		return fmt.Errorf("hooks: %w", err)
+	}
+
+	configLock.Lock()
+	config, managedUsers, autoLockTimeout, maxUnlock = cfg, s.users, s.autoLock, s.maxUnlock
+	configLock.Unlock()
+	if prev := notifier.Swap(n); prev != nil {
+		prev.Close()
+	}
+	return nil
+}
+
+// reloadConfig rereads configFile. An invalid file is rejected and the
+// running config kept.
+func reloadConfig() {
+	cfg, err := loadConfig(configFile)
+	if err == nil {
+		configLock.RLock()
+		prev, prevUsers := config, managedUsers
+		configLock.RUnlock()
+		if err = applyConfig(cfg); err == nil {
+			configReloads.WithLabelValues("ok").Inc()
+			afterReload(prev, prevUsers)
+			return
+		}
+	}
+	log.Printf("Reload rejected, keeping the current config: %v", err)
+	configReloads.WithLabelValues("rejected").Inc()
+}
+
+// afterReload locks users that are no longer managed, makes sure new users
+// start locked, and points out changes that only apply after a restart.
+func afterReload(prev Config, prevUsers []string) {
+	configLock.RLock()
+	cfg, users := config, managedUsers
+	log.Printf("Config reloaded, managing users: %s; auto-lock timeout: %v (maximum %v)",
+		strings.Join(users, ", "), autoLockTimeout, maxUnlock)
+	configLock.RUnlock()
+
+	for _, u := range prevUsers {
+		if !slices.Contains(users, u) && isUnlocked(u) {
+			systemLock(u, "lock", "no longer managed")
+		}
+	}
+	for _, u := range users {
+		if slices.Contains(prevUsers, u) {
+			continue
+		}
+		if isUnlocked(u) {
+			systemLock(u, "lock", "newly managed")
+		} else if err := lockUser(u); err != nil {
+			log.Printf("Lock of %s failed: %v", u, err)
+		}
+	}
+
+	if !reflect.DeepEqual(prev.Audit, cfg.Audit) {
+		log.Printf("Audit settings changed, restart to apply them")
+	}
+	if prev.MetricsAddr != cfg.MetricsAddr {
+		log.Printf("metricsAddr changed, restart to apply it")
+	}
+	if !reflect.DeepEqual(prev.Agent, cfg.Agent) {
+		log.Printf("Agent settings changed, restart to apply them")
+	}
+	logWindows()
+	countRecoveryCodes()
+}
+
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+func configStamp() fileStamp {
+	fi, err := os.Stat(configFile)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}
+}
+
+// watchConfig reloads the config file on SIGHUP, or when its modification
+// time or size changes.
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	last := configStamp()
+	go func() {
+		ticker := time.NewTicker(configPollInterval)
+		for {
+			select {
+			case <-hup:
+				log.Printf("Received SIGHUP, reloading %s", configFile)
+			case <-ticker.C:
+				if configStamp() == last {
+					continue
+				}
+				log.Printf("%s changed, reloading", configFile)
+			}
+			last = configStamp()
+			reloadConfig()
+		}
+	}()
+}
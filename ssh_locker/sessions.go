@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// relockTimer only relocks when the auto-lock timer fires.
+	relockTimer = "timer"
+	// relockLogin relocks as soon as the first login consumed the unlock.
+	relockLogin = "login"
+	// relockSession relocks once the last session opened after the unlock ends.
+	relockSession = "session"
+
+	// journalSource makes the watcher follow sshd in the systemd journal.
+	journalSource = "journal"
+
+	tailPollInterval = 1 * time.Second
+)
+
+var (
+	relockMode = relockTimer
+	authLog    = "/var/log/auth.log"
+
+	acceptedRe = regexp.MustCompile(`Accepted \S+ for (\S+) from`)
+	sessionRe  = regexp.MustCompile(`pam_unix\(sshd:session\): session (opened|closed) for user ([^\s(]+)`)
+
+	// openSessions counts the open sessions of unlocked users. When both
+	// are held, sessionsLock is taken after statesLock.
+	openSessions = map[string]int{}
+	sessionsLock sync.Mutex
+)
+
+// watchSessions follows the sshd log and relocks users according to relockMode.
+func watchSessions() {
+	if relockMode == relockTimer {
+		return
+	}
+	lines := make(chan string)
+	if authLog == journalSource {
+		go followJournal(lines)
+	} else {
+		go followFile(authLog, lines)
+	}
+	go func() {
+		for line := range lines {
+			handleLogLine(line)
+		}
+	}()
+}
+
+func handleLogLine(line string) {
+	if m := acceptedRe.FindStringSubmatch(line); m != nil {
+		onLogin(m[1])
+		return
+	}
+	if m := sessionRe.FindStringSubmatch(line); m != nil {
+		if m[1] == "opened" {
+			onSessionOpened(m[2])
+		} else {
+			onSessionClosed(m[2])
+		}
+	}
+}
+
+func onLogin(username string) {
+	if !isManaged(username) {
+		return
+	}
+	statesLock.Lock()
+	st, ok := states[username]
+	if ok && !st.loggedIn {
+		st.loggedIn = true
+		saveStateLocked()
+	}
+	statesLock.Unlock()
+	if !ok || relockMode != relockLogin {
+		return
+	}
+	log.Printf("Login of %s consumed the unlock, locking", username)
+	systemLock(username, "relock", "login")
+}
+
+// onSessionOpened counts the sessions of a managed user opened while it is
+// unlocked. Sessions opened before, or before the daemon started, don't
+// hold the unlock open.
+func onSessionOpened(username string) {
+	if !isManaged(username) {
+		return
+	}
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	if _, ok := states[username]; !ok {
+		return
+	}
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	openSessions[username]++
+}
+
+func onSessionClosed(username string) {
+	sessionsLock.Lock()
+	remaining, counted := openSessions[username]
+	if counted {
+		remaining--
+		if remaining == 0 {
+			delete(openSessions, username)
+		} else {
+			openSessions[username] = remaining
+		}
+	}
+	sessionsLock.Unlock()
+	if !counted || remaining > 0 || relockMode != relockSession {
+		return
+	}
+	statesLock.Lock()
+	st, ok := states[username]
+	loggedIn := ok && st.loggedIn
+	statesLock.Unlock()
+	if !loggedIn {
+		return
+	}
+	log.Printf("Last session of %s ended, locking", username)
+	systemLock(username, "relock", "session")
+}
+
+// resetSessions forgets the sessions counted for username, when it is
+// unlocked anew. The caller holds statesLock.
+func resetSessions(username string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	delete(openSessions, username)
+}
+
+// followFile tails path like `tail -F`, reopening it when it is rotated.
+func followFile(path string, lines chan<- string) {
+	var (
+		f       *os.File
+		reader  *bufio.Reader
+		partial string
+		opened  bool
+	)
+	for {
+		if f == nil {
+			nf, err := os.Open(path)
+			if err != nil {
+				log.Printf("Can't open %s: %v", path, err)
+				time.Sleep(10 * tailPollInterval)
+				continue
+			}
+			// Skip history on startup, but read rotated-in files from the start.
+			if !opened {
+				nf.Seek(0, io.SeekEnd)
+				opened = true
+			}
+			f, reader = nf, bufio.NewReader(nf)
+		}
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == nil {
+			lines <- partial
+			partial = ""
+			continue
+		}
+		time.Sleep(tailPollInterval)
+		if rotated(f, path) {
+			f.Close()
+			f, partial = nil, ""
+		}
+	}
+}
+
+func rotated(f *os.File, path string) bool {
+	cur, err := f.Stat()
+	if err != nil {
+		return true
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	return !os.SameFile(cur, st) || (err == nil && st.Size() < offset)
+}
+
+// followJournal streams sshd messages from journalctl, restarting it if it exits.
+func followJournal(lines chan<- string) {
+	for {
+		cmd := exec.Command("journalctl", "-f", "-n", "0", "-o", "cat", "-t", "sshd", "-t", "sshd-session")
+		out, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			log.Printf("Can't follow journal: %v", err)
+			time.Sleep(10 * tailPollInterval)
+			continue
+		}
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		cmd.Wait()
+		log.Printf("journalctl exited, restarting")
+		time.Sleep(tailPollInterval)
+	}
+}
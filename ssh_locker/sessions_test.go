@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestSessionCounting(t *testing.T) {
+	savedUsers, savedMode := managedUsers, relockMode
+	t.Cleanup(func() {
+		managedUsers, relockMode = savedUsers, savedMode
+		delete(states, "alice")
+		clear(openSessions)
+	})
+	// The timer mode keeps a last session end from locking for real
+	managedUsers, relockMode = []string{"alice"}, relockTimer
+
+	count := func() int {
+		sessionsLock.Lock()
+		defer sessionsLock.Unlock()
+		return openSessions["alice"]
+	}
+
+	handleLogLine("sshd[1]: pam_unix(sshd:session): session opened for user bob(uid=1001) by (uid=0)")
+	handleLogLine("sshd[2]: pam_unix(sshd:session): session opened for user alice(uid=1000) by (uid=0)")
+	sessionsLock.Lock()
+	counted := len(openSessions)
+	sessionsLock.Unlock()
+	if counted != 0 {
+		t.Fatalf("counted %d sessions of unmanaged or locked users", counted)
+	}
+
+	statesLock.Lock()
+	states["alice"] = &userState{}
+	statesLock.Unlock()
+	onSessionOpened("alice")
+	onSessionOpened("alice")
+	if n := count(); n != 2 {
+		t.Fatalf("counted %d sessions, want 2", n)
+	}
+	// The session opened before the unlock isn't counted when it closes
+	for _, want := range []int{1, 0, 0} {
+		onSessionClosed("alice")
+		if n := count(); n != want {
+			t.Errorf("after close: %d sessions, want %d", n, want)
+		}
+	}
+
+	onSessionOpened("alice")
+	statesLock.Lock()
+	resetSessions("alice")
+	statesLock.Unlock()
+	if n := count(); n != 0 {
+		t.Errorf("after unlock: %d sessions, want 0", n)
+	}
+}
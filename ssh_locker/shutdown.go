@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+var shutdownTimeout = 10 * time.Second
+
+// The listeners and open connections are tracked so a shutdown can stop
+// accepting and drain the commands in flight.
+var (
+	connsLock sync.Mutex
+	listeners []net.Listener
+	conns     = map[net.Conn]bool{}
+	connsWG   sync.WaitGroup
+	closing   bool
+)
+
+// serve accepts connections on ln until shutdown closes it.
+func serve(ln net.Listener) {
+	connsLock.Lock()
+	listeners = append(listeners, ln)
+	connsLock.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			socketErrors.WithLabelValues("accept").Inc()
+			continue
+		}
+		if !trackConn(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer untrackConn(conn)
+			handleConn(conn)
+		}()
+	}
+}
+
+func trackConn(conn net.Conn) bool {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	if closing {
+		return false
+	}
+	conns[conn] = true
+	connsWG.Add(1)
+	return true
+}
+
+func untrackConn(conn net.Conn) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	delete(conns, conn)
+	connsWG.Done()
+}
+
+// clearDeadline removes the deadline of conn, unless shutdown has already
+// set one to wake it up.
+func clearDeadline(conn net.Conn) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	if !closing {
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// shutdown stops accepting connections and waits up to shutdownTimeout for
+// the commands in flight. Then it relocks every user and flushes the audit
+// log and hooks.
+func shutdown() {
+	sshlocker.SdNotify("STOPPING=1")
+	connsLock.Lock()
+	closing = true
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	// Idle clients block in Read; wake them up so they hang up. A command
+	// being handled still gets its reply.
+	for conn := range conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	n := len(conns)
+	connsLock.Unlock()
+	os.Remove(socketPath)
+
+	if n > 0 {
+		log.Printf("Draining %d connection(s)", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	drained := make(chan struct{})
+	go func() {
+		connsWG.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Printf("Commands still running after %v, shutting down anyway", shutdownTimeout)
+	}
+
+	lockAll("shutdown")
+	notifier.Load().Close()
+	if auditLog != nil {
+		if err := auditLog.Close(); err != nil {
+			log.Printf("Can't close audit log: %v", err)
+		}
+	}
+	log.Printf("Shutdown complete")
+}
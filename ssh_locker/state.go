@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var stateFile = "/var/lib/ssh_locker/state.json"
+
+// persistedUser is the on-disk form of an unlocked user's state.
+type persistedUser struct {
+	Deadline time.Time `json:"deadline"`
+	LoggedIn bool      `json:"loggedIn,omitempty"`
+}
+
+type persistedState struct {
+	Unlocked map[string]persistedUser `json:"unlocked"`
+	// Windows maps each window to the start of the occurrence it last
+	// opened.
+	Windows map[string]time.Time `json:"windows,omitempty"`
+}
+
+// saveStateLocked writes the unlocked users and their deadlines, and the
+// opened windows, to stateFile. The caller must hold statesLock.
+func saveStateLocked() {
+	if stateFile == "" {
+		return
+	}
+	ps := persistedState{Unlocked: map[string]persistedUser{}, Windows: opened}
+	for u, st := range states {
+		ps.Unlocked[u] = persistedUser{Deadline: st.deadline, LoggedIn: st.loggedIn}
+	}
+	data, err := json.MarshalIndent(ps, "", "  ")
+	if err != nil {
+		log.Printf("Can't encode state: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0700); err != nil {
+		log.Printf("Can't create state directory: %v", err)
+		return
+	}
+	tmp := stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Can't write state file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, stateFile); err != nil {
+		log.Printf("Can't replace state file: %v", err)
+	}
+}
+
+func loadState() (persistedState, error) {
+	ps := persistedState{}
+	if stateFile == "" {
+		return ps, nil
+	}
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return ps, nil
+	}
+	if err != nil {
+		return ps, err
+	}
+	err = json.Unmarshal(data, &ps)
+	return ps, err
+}
+
+// restoreState reconciles the on-disk keys with the persisted deadlines:
+// users whose deadline is still ahead stay unlocked for the remaining time,
+// everyone else is locked. Windows that already opened aren't opened again.
+func restoreState() {
+	ps, err := loadState()
+	if err != nil {
+		log.Printf("Can't read state file, locking everyone: %v", err)
+	}
+	statesLock.Lock()
+	for name, start := range ps.Windows {
+		opened[name] = start
+	}
+	statesLock.Unlock()
+	for _, u := range managedUsers {
+		pu, ok := ps.Unlocked[u]
+		remaining := time.Until(pu.Deadline)
+		if ok && remaining > 0 && isUnlocked(u) {
+			log.Printf("Restoring unlock of %s, auto-lock in %s", u, formatRemaining(remaining))
+			startAutoLock(u, remaining)
+			statesLock.Lock()
+			states[u].loggedIn = pu.LoggedIn
+			saveStateLocked()
+			statesLock.Unlock()
+			continue
+		}
+		if isUnlocked(u) {
+			systemLock(u, "lock", "startup")
+		} else if err := lockUser(u); err != nil {
+			log.Printf("Lock of %s failed: %v", u, err)
+		}
+	}
+}
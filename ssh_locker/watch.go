@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+const (
+	watchBuffer       = 64
+	watchWriteTimeout = 10 * time.Second
+)
+
+// watchers are the channels of the connections streaming events.
+var (
+	watchersLock sync.Mutex
+	watchers     = map[chan sshlocker.Event]bool{}
+)
+
+// publish hands e to every watcher. A watcher that falls behind loses
+// events rather than stalling the daemon.
+func publish(e sshlocker.Event) {
+	e.Time = time.Now().UTC()
+	e.Host = hostName
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+	for ch := range watchers {
+		select {
+		case ch <- e:
+		default:
+			socketErrors.WithLabelValues("watch_overflow").Inc()
+		}
+	}
+}
+
+// streamEvents writes every event to conn as a JSON line until the client
+// hangs up, which is noticed by reading the rest of its input.
+func streamEvents(conn net.Conn, scanner *bufio.Scanner) {
+	ch := make(chan sshlocker.Event, watchBuffer)
+	watchersLock.Lock()
+	watchers[ch] = true
+	watchersLock.Unlock()
+	defer func() {
+		watchersLock.Lock()
+		delete(watchers, ch)
+		watchersLock.Unlock()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for scanner.Scan() {
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case e := <-ch:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("Can't encode event: %v", err)
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+			if _, err := conn.Write(append(data, '\n')); err != nil {
+				socketErrors.WithLabelValues("write").Inc()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+// Out-of-window policies for unlock and extend requests.
+const (
+	outOfWindowAllow = "allow"
+	outOfWindowDeny  = "deny"
+	// outOfWindowEscalate only accepts requests that passed a second
+	// factor, i.e. came through ssh_locker_web.
+	outOfWindowEscalate = "escalate"
+)
+
+const windowCheckInterval = 30 * time.Second
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// WindowConfig is a recurring maintenance window during which Users are
+// unlocked, e.g. {"days": ["tue"], "start": "02:00", "end": "04:00"}. A
+// window whose end is before its start ends on the next day.
+type WindowConfig struct {
+	Name  string   `json:"name"`
+	Users []string `json:"users"`
+	// Days are the days the window starts on (sun, mon, ...); empty means
+	// every day.
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	// Timezone is an IANA zone name, UTC by default.
+	Timezone string `json:"timezone,omitempty"`
+	// OutOfWindow is allow (default), deny or escalate.
+	OutOfWindow string `json:"outOfWindow,omitempty"`
+
+	days       []time.Weekday
+	start, end time.Duration
+	loc        *time.Location
+}
+
+// parseClock parses "15:04" into the time since midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *WindowConfig) resolve() error {
+	if w.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if len(w.Users) == 0 {
+		return fmt.Errorf("no users")
+	}
+	for _, d := range w.Days {
+		wd, ok := weekdays[strings.ToLower(d)[:min(3, len(d))]]
+		if !ok {
+			return fmt.Errorf("invalid day %q", d)
+		}
+		w.days = append(w.days, wd)
+	}
+	var err error
+	if w.start, err = parseClock(w.Start); err != nil {
+		return err
+	}
+	if w.end, err = parseClock(w.End); err != nil {
+		return err
+	}
+	if w.start == w.end {
+		return fmt.Errorf("start and end are equal")
+	}
+	w.loc = time.UTC
+	if w.Timezone != "" {
+		if w.loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return err
+		}
+	}
+	switch w.OutOfWindow {
+	case "":
+		w.OutOfWindow = outOfWindowAllow
+	case outOfWindowAllow, outOfWindowDeny, outOfWindowEscalate:
+	default:
+		return fmt.Errorf("invalid outOfWindow %q", w.OutOfWindow)
+	}
+	return nil
+}
+
+// occurrence returns the start and end of the window occurrence containing
+// t, if any.
+func (w *WindowConfig) occurrence(t time.Time) (time.Time, time.Time, bool) {
+	t = t.In(w.loc)
+	// An occurrence that wraps past midnight may have started yesterday
+	for _, offset := range []int{0, -1} {
+		day := time.Date(t.Year(), t.Month(), t.Day()+offset, 0, 0, 0, 0, w.loc)
+		if len(w.days) > 0 && !slices.Contains(w.days, day.Weekday()) {
+			continue
+		}
+		// Start and end are wall clock times, so they stay put on the days
+		// daylight saving time begins or ends
+		endDay := day.Day()
+		if w.end < w.start {
+			endDay++
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), 0, int(w.start/time.Minute), 0, 0, w.loc)
+		end := time.Date(day.Year(), day.Month(), endDay, 0, int(w.end/time.Minute), 0, 0, w.loc)
+		if !t.Before(start) && t.Before(end) {
+			return start, end, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// opened records the start of the occurrence each window last unlocked its
+// users for, so a user locked by hand during a window stays locked. It is
+// guarded by statesLock and kept in the state file, so that also holds
+// across restarts.
+var opened = map[string]time.Time{}
+
+func logWindows() {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	for _, w := range config.Windows {
+		days := "every day"
+		if len(w.Days) > 0 {
+			days = strings.Join(w.Days, ",")
+		}
+		log.Printf("Window %s: %s %s-%s %s for %s (out of window: %s)",
+			w.Name, days, w.Start, w.End, w.loc, strings.Join(w.Users, ", "), w.OutOfWindow)
+	}
+}
+
+// watchWindows unlocks the users of a window when it opens. They are
+// relocked by the auto-lock timer, which is set to the end of the window.
+// It runs even without windows, as a reload may add some.
+func watchWindows() {
+	logWindows()
+	checkWindows(time.Now())
+	go func() {
+		for now := range time.Tick(windowCheckInterval) {
+			checkWindows(now)
+		}
+	}()
+}
+
+func checkWindows(now time.Time) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	for i := range config.Windows {
+		w := &config.Windows[i]
+		start, end, ok := w.occurrence(now)
+		if !ok || !markOpened(w.Name, start) {
+			continue
+		}
+		for _, u := range w.Users {
+			openWindow(w, u, end)
+		}
+	}
+}
+
+// markOpened records that the occurrence of window name starting at start
+// opened, and reports whether it hadn't already.
+func markOpened(name string, start time.Time) bool {
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	if opened[name].Equal(start) {
+		return false
+	}
+	opened[name] = start
+	saveStateLocked()
+	return true
+}
+
+// openWindow unlocks username until end, unless it is already unlocked for
+// longer.
+func openWindow(w *WindowConfig, username string, end time.Time) {
+	d := time.Until(end).Round(time.Second)
+	if remaining, ok := remainingTime(username); ok && remaining >= d {
+		return
+	}
+	req := sshlocker.Request{Command: "unlock", User: username, Duration: d.String(), Reason: "window " + w.Name}
+	log.Printf("Window %s open, unlocking %s until %s", w.Name, username, end.Format(time.RFC3339))
+	if err := unlockUser(username, d); err != nil {
+		log.Printf("Window unlock of %s failed: %v", username, err)
+		recordEvent("window", req, nil, err.Error())
+		return
+	}
+	recordEvent("window", req, nil, "ok")
+}
+
+// checkWindowPolicy returns an error if req may not unlock username now
+// because it is outside the user's windows. Inside any of them everything is
+// allowed; outside, the strictest policy of the user's windows applies.
+// Escalation needs a second factor attested by a trusted peer; unlock
+// tokens don't carry one.
+func checkWindowPolicy(username string, peer peerCred, req sshlocker.Request) error {
+	policy := outOfWindowAllow
+	for i := range config.Windows {
+		w := &config.Windows[i]
+		if !slices.Contains(w.Users, username) {
+			continue
+		}
+		if _, _, ok := w.occurrence(time.Now()); ok {
+			return nil
+		}
+		switch {
+		case w.OutOfWindow == outOfWindowDeny:
+			policy = outOfWindowDeny
+		case w.OutOfWindow == outOfWindowEscalate && policy == outOfWindowAllow:
+			policy = outOfWindowEscalate
+		}
+	}
+	switch {
+	case policy == outOfWindowDeny:
+		return fmt.Errorf("outside the maintenance window of %s", username)
+	case policy == outOfWindowEscalate && (!attests(config.ACL, peer) || req.AuthUser == "" || req.FailOpen || req.TokenID != ""):
+		return fmt.Errorf("outside the maintenance window of %s, a second factor is required", username)
+	}
+	return nil
+}
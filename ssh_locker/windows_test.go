@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+func mustWindow(t *testing.T, w WindowConfig) *WindowConfig {
+	t.Helper()
+	w.Name, w.Users = "test", []string{"alice"}
+	if err := w.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	return &w
+}
+
+func TestWindowOccurrence(t *testing.T) {
+	daily := mustWindow(t, WindowConfig{Start: "09:00", End: "17:00"})
+	// Friday 22:00 until Saturday 02:00
+	overnight := mustWindow(t, WindowConfig{Days: []string{"fri"}, Start: "22:00", End: "02:00"})
+	// Europe/Berlin switches to CEST on 2025-03-30 02:00 and back to CET on
+	// 2025-10-26 03:00
+	berlin := mustWindow(t, WindowConfig{Start: "01:00", End: "04:00", Timezone: "Europe/Berlin"})
+	berlinOvernight := mustWindow(t, WindowConfig{Start: "22:00", End: "06:00", Timezone: "Europe/Berlin"})
+
+	tests := []struct {
+		name       string
+		w          *WindowConfig
+		at         string
+		start, end string
+	}{
+		{"before start", daily, "2025-06-02T08:59:00Z", "", ""},
+		{"at start", daily, "2025-06-02T09:00:00Z", "2025-06-02T09:00:00Z", "2025-06-02T17:00:00Z"},
+		{"at end", daily, "2025-06-02T17:00:00Z", "", ""},
+		{"overnight before midnight", overnight, "2025-06-06T23:00:00Z", "2025-06-06T22:00:00Z", "2025-06-07T02:00:00Z"},
+		{"overnight after midnight", overnight, "2025-06-07T01:00:00Z", "2025-06-06T22:00:00Z", "2025-06-07T02:00:00Z"},
+		{"overnight ended", overnight, "2025-06-07T02:00:00Z", "", ""},
+		{"overnight other day", overnight, "2025-06-07T23:00:00Z", "", ""},
+		{"overnight day before", overnight, "2025-06-06T01:00:00Z", "", ""},
+		{"spring forward", berlin, "2025-03-30T03:30:00+02:00", "2025-03-30T01:00:00+01:00", "2025-03-30T04:00:00+02:00"},
+		{"spring forward ended", berlin, "2025-03-30T04:30:00+02:00", "", ""},
+		{"fall back", berlin, "2025-10-26T03:30:00+01:00", "2025-10-26T01:00:00+02:00", "2025-10-26T04:00:00+01:00"},
+		{"fall back ended", berlin, "2025-10-26T04:00:00+01:00", "", ""},
+		{"overnight spring forward", berlinOvernight, "2025-03-30T05:30:00+02:00", "2025-03-29T22:00:00+01:00", "2025-03-30T06:00:00+02:00"},
+		{"overnight fall back", berlinOvernight, "2025-10-26T05:30:00+01:00", "2025-10-25T22:00:00+02:00", "2025-10-26T06:00:00+01:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at, err := time.Parse(time.RFC3339, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start, end, ok := tt.w.occurrence(at)
+			if tt.start == "" {
+				if ok {
+					t.Errorf("occurrence = %v - %v, want none", start, end)
+				}
+				return
+			}
+			wantStart, _ := time.Parse(time.RFC3339, tt.start)
+			wantEnd, _ := time.Parse(time.RFC3339, tt.end)
+			if !ok || !start.Equal(wantStart) || !end.Equal(wantEnd) {
+				t.Errorf("occurrence = %v - %v, %v, want %v - %v", start, end, ok, wantStart, wantEnd)
+			}
+		})
+	}
+}
+
+func TestCheckWindowPolicyEscalate(t *testing.T) {
+	// A window on a day that is neither today nor yesterday is closed now
+	day := time.Now().AddDate(0, 0, 3).Weekday().String()[:3]
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.ACL = []ACLRule{{CommonNames: []string{"web"}, Commands: []string{"unlock", attestCommand}}}
+	config.Windows = []WindowConfig{*mustWindow(t, WindowConfig{Days: []string{day}, Start: "00:00", End: "00:01", OutOfWindow: outOfWindowEscalate})}
+
+	web := peerCred{cn: "web"}
+	tests := []struct {
+		name  string
+		peer  peerCred
+		req   sshlocker.Request
+		allow bool
+	}{
+		{"second factor", web, sshlocker.Request{AuthUser: "alice"}, true},
+		{"no second factor", web, sshlocker.Request{}, false},
+		{"fail open", web, sshlocker.Request{AuthUser: "alice", FailOpen: true}, false},
+		{"unlock token", web, sshlocker.Request{AuthUser: "alice", TokenID: "t1"}, false},
+		{"peer not attesting", peerCred{cn: "other"}, sshlocker.Request{AuthUser: "alice"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkWindowPolicy("alice", tt.peer, tt.req)
+			if (err == nil) != tt.allow {
+				t.Errorf("checkWindowPolicy = %v, want allowed %v", err, tt.allow)
+			}
+		})
+	}
+}
+
+func TestMarkOpenedPersists(t *testing.T) {
+	savedFile, savedUsers := stateFile, managedUsers
+	t.Cleanup(func() {
+		stateFile, managedUsers = savedFile, savedUsers
+		clear(opened)
+	})
+	stateFile, managedUsers = t.TempDir()+"/state.json", nil
+
+	start := time.Date(2025, 6, 2, 9, 0, 0, 0, time.UTC)
+	if !markOpened("maint", start) {
+		t.Fatal("first occurrence not opened")
+	}
+	if markOpened("maint", start) {
+		t.Error("same occurrence opened twice")
+	}
+
+	// A restarted daemon doesn't open the occurrence again
+	clear(opened)
+	restoreState()
+	if markOpened("maint", start) {
+		t.Error("occurrence opened again after a restart")
+	}
+	if !markOpened("maint", start.AddDate(0, 0, 1)) {
+		t.Error("next occurrence not opened")
+	}
+}
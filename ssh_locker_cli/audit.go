@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+const defaultAuditFile = "/var/log/ssh_locker/audit.log"
+
+// runAudit prints the audit log entries matching the given filters.
+func runAudit(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	file := fs.String("f", defaultAuditFile, "Path to the audit log")
+	user := fs.String("user", "", "Only show entries for this user")
+	event := fs.String("event", "", "Only show entries of this event")
+	since := fs.Duration("since", 0, "Only show entries newer than this (e.g. 24h)")
+	fs.BoolVar(&asJSON, "json", asJSON, "Print entries as JSON lines")
+	verify := fs.Bool("verify", false, "Verify the hash chain")
+	fs.Parse(args)
+
+	entries, err := sshlocker.ReadAuditLog(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Audit log error:", err)
+		return exitUnavailable
+	}
+	if *verify {
+		if i := sshlocker.VerifyAuditChain(entries); i >= 0 {
+			fmt.Fprintf(os.Stderr, "Hash chain broken at entry %d (%s)\n", i+1, entries[i].Time.Format(time.RFC3339))
+			return exitFailed
+		}
+		start := sshlocker.AuditChainStart(entries)
+		if start == len(entries) {
+			fmt.Fprintf(os.Stderr, "No hash chain (%d entries written before chaining was enabled)\n", len(entries))
+			return exitFailed
+		}
+		if start > 0 {
+			fmt.Printf("Hash chain intact (%d entries, the first %d written before chaining was enabled)\n", len(entries), start)
+			return 0
+		}
+		fmt.Printf("Hash chain intact (%d entries)\n", len(entries))
+		return 0
+	}
+	for _, e := range entries {
+		if *user != "" && e.User != *user {
+			continue
+		}
+		if *event != "" && e.Event != *event {
+			continue
+		}
+		if *since > 0 && time.Since(e.Time) > *since {
+			continue
+		}
+		if asJSON {
+			data, _ := json.Marshal(e)
+			fmt.Println(string(data))
+			continue
+		}
+		fmt.Println(formatAuditEntry(e))
+	}
+	return 0
+}
+
+func formatAuditEntry(e sshlocker.AuditEntry) string {
+	parts := []string{e.Time.Local().Format(time.RFC3339), e.Event, e.User}
+	if e.Duration != "" {
+		parts = append(parts, "for="+e.Duration)
+	}
+	parts = append(parts, "result="+e.Result)
+	if e.PeerUID != nil {
+		parts = append(parts, fmt.Sprintf("uid=%d", *e.PeerUID))
+	}
+	if e.PeerCN != "" {
+		parts = append(parts, "cn="+e.PeerCN)
+	}
+	if e.RemoteIP != "" {
+		parts = append(parts, "ip="+e.RemoteIP)
+	}
+	if e.AuthUser != "" {
+		parts = append(parts, "by="+e.AuthUser)
+	}
+	if e.Client != "" {
+		parts = append(parts, "client="+e.Client)
+	}
+	if len(e.ApprovedBy) > 0 {
+		parts = append(parts, "approved-by="+strings.Join(e.ApprovedBy, ","))
+	}
+	if e.TokenID != "" {
+		parts = append(parts, "token="+e.TokenID)
+	}
+	if e.FailOpen {
+		parts = append(parts, "fail-open")
+	}
+	if e.Reason != "" {
+		parts = append(parts, fmt.Sprintf("reason=%q", e.Reason))
+	}
+	return strings.Join(parts, " ")
+}
@@ -2,44 +2,220 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"net"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
 )
 
-var socketPath = "/var/run/ssh_locker.sock"
+// Exit codes, so scripts don't have to parse the output.
+const (
+	exitOK = 0
+	// exitFailed means the daemon ran the command and it failed.
+	exitFailed = 1
+	exitUsage  = 2
+	// exitDenied means the ACL doesn't allow the command.
+	exitDenied = 3
+	// exitUnavailable means the daemon, or ssh_locker_web, couldn't be
+	// reached.
+	exitUnavailable = 4
+	// exitPending means ssh_locker_web holds the request for approval.
+	exitPending = 5
+)
+
+var (
+	socketPath = sshlocker.DefaultSocketPath
+	asJSON     bool
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: client [-s socket] [--json] <command> [options]")
+	fmt.Fprintln(os.Stderr, "       client -url https://locker.example.com [-as user] [-host host] [-open] <command> [options]")
+	fmt.Fprintln(os.Stderr, "       client lock [--user user]")
+	fmt.Fprintln(os.Stderr, "       client unlock [--for duration] [--user user]")
+	fmt.Fprintln(os.Stderr, "       client extend --for duration [--user user]")
+	fmt.Fprintln(os.Stderr, "       client status [--user user]")
+	fmt.Fprintln(os.Stderr, "       client list")
+	fmt.Fprintln(os.Stderr, "       client recover [--for duration] [--user user] [code]")
+	fmt.Fprintln(os.Stderr, "       client watch [--user user]")
+	fmt.Fprintln(os.Stderr, "       client audit [-f file] [-user user] [-event event] [-since 24h] [-verify]")
+	fmt.Fprintln(os.Stderr, "Remote mode authenticates with $SSH_LOCKER_TOKEN, -token-file or -cert; watch and audit are local only.")
+	fmt.Fprintln(os.Stderr, "Exit codes: 0 ok, 1 command failed, 2 usage, 3 permission denied, 4 unreachable, 5 waiting for approval")
+}
 
 func main() {
 	var socket string
 	flag.StringVar(&socket, "s", socketPath, "Path to unix socket")
+	flag.BoolVar(&asJSON, "json", false, "Print JSON instead of text")
+	flag.StringVar(&remoteCfg.URL, "url", os.Getenv("SSH_LOCKER_URL"), "ssh_locker_web to send commands to instead of the local daemon")
+	flag.StringVar(&remoteCfg.TokenFile, "token-file", "", "File holding the API token (default: $SSH_LOCKER_TOKEN)")
+	flag.StringVar(&remoteCfg.As, "as", "", "User passing the second factor (default: $USER)")
+	flag.StringVar(&remoteCfg.Host, "host", "", "Managed host, if ssh_locker_web manages several")
+	flag.StringVar(&remoteCfg.CA, "ca", "", "CA bundle to verify ssh_locker_web with")
+	flag.StringVar(&remoteCfg.Cert, "cert", "", "Client certificate to authenticate with")
+	flag.StringVar(&remoteCfg.Key, "key", "", "Key of the client certificate")
+	flag.BoolVar(&remoteCfg.Open, "open", false, "Open the second factor prompt in a browser")
+	flag.DurationVar(&remoteCfg.Wait, "wait", 5*time.Minute, "How long to wait for the second factor")
+	flag.Usage = usage
 	flag.Parse()
-	if len(flag.Args()) != 1 {
-		fmt.Println("Usage: client [lock|unlock]")
-		os.Exit(1)
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(exitUsage)
 	}
 	if socket != "" {
 		socketPath = socket
 	}
-	cmd := flag.Arg(0)
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	if remoteCfg.URL != "" && (cmd == "watch" || cmd == "audit") {
+		fmt.Fprintf(os.Stderr, "%s is only available locally\n", cmd)
+		os.Exit(exitUsage)
+	}
+	switch cmd {
+	case "audit":
+		os.Exit(runAudit(args))
+	case "watch":
+		os.Exit(runWatch(args))
+	case "lock", "unlock", "extend", "status", "list", "recover":
+		os.Exit(runCommand(cmd, args))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", cmd)
+		usage()
+		os.Exit(exitUsage)
+	}
+}
 
-	conn, err := net.Dial("unix", socketPath)
-	if err != nil {
-		fmt.Println("Dial error:", err)
-		return
+// runCommand sends a daemon command and prints its reply.
+func runCommand(cmd string, args []string) int {
+	req := sshlocker.Request{Command: cmd, JSON: true}
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.BoolVar(&asJSON, "json", asJSON, "Print JSON instead of text")
+	if cmd != "list" {
+		fs.StringVar(&req.User, "user", "", "Managed user (default: the daemon's first user)")
+	}
+	if cmd == "unlock" || cmd == "extend" || cmd == "recover" {
+		fs.StringVar(&req.Duration, "for", "", "How long to stay unlocked, e.g. 10m")
+	}
+	if cmd == "lock" || cmd == "unlock" || cmd == "extend" {
+		fs.StringVar(&req.Reason, "reason", "", "Why, for the audit log and approvers")
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	// The positional forms of earlier versions still work:
+	// unlock [duration] [user], extend <duration> [user], recover [code] [duration] [user]
+	rest := fs.Args()
+	if cmd == "recover" {
+		req.Code, rest = argAt(rest, 0), rest[min(1, len(rest)):]
+		if req.Code == "" {
+			// Read the code from stdin so it doesn't end up in the shell history
+			code, err := prompt("Recovery code: ")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitUsage
+			}
+			req.Code = code
+		}
+	}
+	if len(rest) > 0 && req.Duration == "" {
+		switch cmd {
+		case "unlock", "recover":
+			if _, err := time.ParseDuration(rest[0]); err == nil || len(rest) > 1 {
+				req.Duration, rest = rest[0], rest[1:]
+			}
+		case "extend":
+			req.Duration, rest = rest[0], rest[1:]
+		}
+	}
+	if len(rest) > 0 && req.User == "" && cmd != "list" {
+		req.User, rest = rest[0], rest[1:]
+	}
+	if len(rest) > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(rest, " "))
+		return exitUsage
+	}
+	if cmd == "extend" && req.Duration == "" {
+		fmt.Fprintln(os.Stderr, "extend needs --for")
+		return exitUsage
 	}
-	defer conn.Close()
 
-	_, err = fmt.Fprintf(conn, "%s\n", cmd)
+	if remoteCfg.URL != "" {
+		rm, err := newRemote(remoteCfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		return printReply(rm.run(req))
+	}
+	resp, err := sshlocker.SendRequest(socketPath, req)
 	if err != nil {
-		fmt.Println("Write error:", err)
-		return
+		return printReply(sshlocker.Reply{Status: "unavailable", Message: err.Error()})
 	}
+	return printReply(decodeReply(resp))
+}
 
-	resp, err := bufio.NewReader(conn).ReadString('\n')
+// decodeReply decodes a JSON reply. Daemons predating JSON replies answer
+// with a text line, whose status is guessed the way ssh_locker_web does.
+func decodeReply(resp string) sshlocker.Reply {
+	var reply sshlocker.Reply
+	if strings.HasPrefix(resp, "{") && json.Unmarshal([]byte(resp), &reply) == nil {
+		return reply
+	}
+	reply = sshlocker.Reply{Status: sshlocker.ReplyOK, Message: resp}
+	switch {
+	case resp == "Permission denied":
+		reply.Status = sshlocker.ReplyDenied
+	case resp == "Unknown command", strings.Contains(resp, " failed: "):
+		reply.Status = sshlocker.ReplyError
+	}
+	return reply
+}
+
+// printReply prints reply and returns the matching exit code.
+func printReply(reply sshlocker.Reply) int {
+	code := exitCode(reply.Status)
+	if asJSON {
+		data, _ := json.Marshal(reply)
+		fmt.Println(string(data))
+	} else if code == exitOK || code == exitPending {
+		fmt.Println(reply.Message)
+	} else {
+		fmt.Fprintln(os.Stderr, reply.Message)
+	}
+	return code
+}
+
+func exitCode(status string) int {
+	switch status {
+	case sshlocker.ReplyOK:
+		return exitOK
+	case sshlocker.ReplyDenied:
+		return exitDenied
+	case sshlocker.ReplyError:
+		return exitFailed
+	case statusPendingApproval:
+		return exitPending
+	}
+	return exitUnavailable
+}
+
+// prompt reads a line from stdin after printing label to stderr.
+func prompt(label string) (string, error) {
+	fmt.Fprint(os.Stderr, label)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
 	if err != nil {
-		fmt.Println("Read error:", err)
-		return
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func argAt(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
 	}
-	fmt.Print(resp)
+	return ""
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+const (
+	pollInterval  = 2 * time.Second
+	remoteTimeout = 30 * time.Second
+	// statusPendingApproval is the status of a request ssh_locker_web
+	// holds until other users approve it.
+	statusPendingApproval = "pending_approval"
+)
+
+// remoteConfig is where and as whom remote mode talks to ssh_locker_web.
+type remoteConfig struct {
+	URL       string
+	TokenFile string
+	As        string
+	Host      string
+	CA        string
+	Cert      string
+	Key       string
+	Open      bool
+	Wait      time.Duration
+}
+
+var remoteCfg remoteConfig
+
+// remote sends commands to the API of an ssh_locker_web instance.
+type remote struct {
+	remoteConfig
+	token  string
+	client *http.Client
+}
+
+func newRemote(cfg remoteConfig) (*remote, error) {
+	rm := &remote{remoteConfig: cfg, token: os.Getenv("SSH_LOCKER_TOKEN")}
+	rm.URL = strings.TrimSuffix(rm.URL, "/")
+	if cfg.TokenFile != "" {
+		data, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		rm.token = strings.TrimSpace(string(data))
+	}
+	if rm.token == "" && cfg.Cert == "" {
+		return nil, fmt.Errorf("set SSH_LOCKER_TOKEN, -token-file or -cert to authenticate")
+	}
+	if rm.As == "" {
+		rm.As = os.Getenv("USER")
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CA != "" {
+		pool, err := sshlocker.LoadCertPool(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if cfg.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	rm.client = &http.Client{
+		Timeout:   remoteTimeout,
+		Transport: &http.Transport{TLSClientConfig: tc, Proxy: http.ProxyFromEnvironment},
+	}
+	return rm, nil
+}
+
+// apiResponse covers every body ssh_locker_web answers with.
+type apiResponse struct {
+	Status    string         `json:"status"`
+	Message   string         `json:"message"`
+	ID        string         `json:"id"`
+	URL       string         `json:"url"`
+	State     string         `json:"state"`
+	Challenge map[string]any `json:"challenge"`
+	// Approval and Code are set by /requests/{id}.
+	Approval string `json:"approval"`
+	Code     string `json:"code"`
+	Error    *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (rm *remote) do(method, path string, body any) (int, apiResponse, error) {
+	var resp apiResponse
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, resp, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	r, err := http.NewRequest(method, rm.URL+path, reader)
+	if err != nil {
+		return 0, resp, err
+	}
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Content-Type", "application/json")
+	if rm.token != "" {
+		r.Header.Set("Authorization", "Bearer "+rm.token)
+	}
+	res, err := rm.client.Do(r)
+	if err != nil {
+		return 0, resp, err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return res.StatusCode, resp, fmt.Errorf("unexpected %s response: %w", res.Status, err)
+	}
+	return res.StatusCode, resp, nil
+}
+
+// run performs req through ssh_locker_web, walking the user through the
+// second factor: a prompt URL is printed (and opened with -open) and polled
+// until it completes, a TOTP code is asked for.
+func (rm *remote) run(req sshlocker.Request) sshlocker.Reply {
+	status, resp, err := rm.do(http.MethodPost, "/action", rm.action(req))
+	for {
+		switch {
+		case err != nil:
+			return sshlocker.Reply{Status: "unavailable", Message: err.Error()}
+		case resp.Error != nil:
+			return sshlocker.Reply{Status: errorStatus(status), Message: resp.Error.Message}
+		case resp.Status == "pending" && resp.URL != "":
+			fmt.Fprintf(os.Stderr, "Complete the second factor at:\n  %s\n", resp.URL)
+			if rm.Open {
+				if err := openBrowser(resp.URL); err != nil {
+					fmt.Fprintf(os.Stderr, "Can't open a browser: %v\n", err)
+				}
+			}
+			return rm.poll(resp.ID)
+		case resp.State != "" && resp.Challenge != nil:
+			if resp.Challenge["type"] != "totp" {
+				return sshlocker.Reply{Status: sshlocker.ReplyError, Message: fmt.Sprintf("The %v second factor is only supported by the web UI", resp.Challenge["type"])}
+			}
+			var code string
+			if code, err = prompt("Code: "); err != nil {
+				return sshlocker.Reply{Status: sshlocker.ReplyError, Message: err.Error()}
+			}
+			status, resp, err = rm.do(http.MethodPost, "/verify", map[string]string{"state": resp.State, "code": code})
+		case resp.Status == statusPendingApproval:
+			return sshlocker.Reply{Status: statusPendingApproval, Message: fmt.Sprintf("%s (request %s)", resp.Message, resp.ID)}
+		default:
+			return sshlocker.Reply{Status: sshlocker.ReplyOK, Message: resp.Message}
+		}
+	}
+}
+
+// action is the body of the /action request for req.
+func (rm *remote) action(req sshlocker.Request) map[string]string {
+	return map[string]string{
+		"user":     rm.As,
+		"action":   req.Command,
+		"account":  req.User,
+		"host":     rm.Host,
+		"duration": req.Duration,
+		"reason":   req.Reason,
+		"code":     req.Code,
+	}
+}
+
+// poll waits for the request id to finish, for at most rm.Wait.
+func (rm *remote) poll(id string) sshlocker.Reply {
+	deadline := time.Now().Add(rm.Wait)
+	for time.Now().Before(deadline) {
+		time.Sleep(pollInterval)
+		status, resp, err := rm.do(http.MethodGet, "/requests/"+url.PathEscape(id), nil)
+		switch {
+		case err != nil:
+			return sshlocker.Reply{Status: "unavailable", Message: err.Error()}
+		case resp.Error != nil:
+			return sshlocker.Reply{Status: errorStatus(status), Message: resp.Error.Message}
+		case resp.Status == "executed":
+			return sshlocker.Reply{Status: sshlocker.ReplyOK, Message: resp.Message}
+		case resp.Status == "denied":
+			return sshlocker.Reply{Status: sshlocker.ReplyDenied, Message: resp.Message}
+		case resp.Status == "failed":
+			return sshlocker.Reply{Status: failedStatus(resp.Code), Message: resp.Message}
+		case resp.Approval != "":
+			return sshlocker.Reply{Status: statusPendingApproval, Message: fmt.Sprintf("%s (request %s)", resp.Message, resp.Approval)}
+		}
+	}
+	return sshlocker.Reply{Status: "unavailable", Message: fmt.Sprintf("no answer after %v", rm.Wait)}
+}
+
+// errorStatus maps the HTTP status of an API error to a reply status.
+func errorStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return sshlocker.ReplyDenied
+	case status == http.StatusTooManyRequests, status >= 500:
+		return "unavailable"
+	}
+	return sshlocker.ReplyError
+}
+
+// failedStatus maps the error code of a failed request to a reply status.
+func failedStatus(code string) string {
+	switch code {
+	case "auth_denied", "forbidden":
+		return sshlocker.ReplyDenied
+	case "auth_unavailable", "socket_error", "too_many_pending", "request_expired":
+		return "unavailable"
+	}
+	return sshlocker.ReplyError
+}
+
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+// errRefused stops a watch the daemon didn't accept.
+var errRefused = errors.New("watch refused")
+
+// runWatch prints the daemon's events as they happen, until interrupted or
+// the daemon goes away.
+func runWatch(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	user := fs.String("user", "", "Only show events for this user")
+	fs.BoolVar(&asJSON, "json", asJSON, "Print events as JSON lines")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return exitUsage
+	}
+
+	agent := sshlocker.Agent{Network: "unix", Address: socketPath}
+	code, first := exitUnavailable, true
+	err := agent.Watch(sshlocker.Request{Command: "watch", JSON: true}, func(line string) error {
+		if first {
+			first = false
+			reply := decodeReply(line)
+			if reply.Status != sshlocker.ReplyOK {
+				code = printReply(reply)
+				return errRefused
+			}
+			if !asJSON {
+				fmt.Fprintln(os.Stderr, "Watching for state changes, interrupt to stop")
+			}
+			return nil
+		}
+		var e sshlocker.Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return fmt.Errorf("invalid event: %w", err)
+		}
+		if *user != "" && e.User != *user {
+			return nil
+		}
+		if asJSON {
+			fmt.Println(line)
+		} else {
+			fmt.Println(formatEvent(e))
+		}
+		return nil
+	})
+	if errors.Is(err, errRefused) {
+		return code
+	}
+	fmt.Fprintln(os.Stderr, err)
+	return exitUnavailable
+}
+
+func formatEvent(e sshlocker.Event) string {
+	parts := []string{e.Time.Local().Format(time.RFC3339), e.Event, e.User}
+	if e.Duration != "" {
+		parts = append(parts, "for="+e.Duration)
+	}
+	if e.AuthUser != "" {
+		parts = append(parts, "by="+e.AuthUser)
+	}
+	if e.Client != "" {
+		parts = append(parts, "client="+e.Client)
+	}
+	if e.RemoteIP != "" {
+		parts = append(parts, "ip="+e.RemoteIP)
+	}
+	if e.TokenID != "" {
+		parts = append(parts, "token="+e.TokenID)
+	}
+	if e.Reason != "" {
+		parts = append(parts, fmt.Sprintf("reason=%q", e.Reason))
+	}
+	if e.Error != "" {
+		parts = append(parts, fmt.Sprintf("error=%q", e.Error))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleAction starts an action for an API client: POST /action.
+func (s *server) handleAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST allowed")
+		return
+	}
+	client := s.apiClient(w, r)
+	if client == nil {
+		return
+	}
+
+	var req ActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestsTotal.WithLabelValues("unknown", "invalid").Inc()
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request")
+		return
+	}
+	s.respondAction(w, r, client, req)
+}
+
+// apiClient authenticates the API client of r. It writes the error response
+// and returns nil if that fails.
+func (s *server) apiClient(w http.ResponseWriter, r *http.Request) *APIClient {
+	client, err := authenticateClient(s.current().clients, r)
+	if err != nil {
+		if client != nil {
+			log.Printf("Rejected API client %s from %s: %v", client.Name, s.clientIP(r), err)
+		}
+		requestsTotal.WithLabelValues("unknown", "unauthorized").Inc()
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return nil
+	}
+	return client
+}
+
+// respondAction starts req and writes its result or challenge.
+func (s *server) respondAction(w http.ResponseWriter, r *http.Request, client *APIClient, req ActionRequest) {
+	result, err := s.startAction(r, client, req, false)
+	if err != nil || result.challenge == nil {
+		s.writeResult(w, result, err)
+		return
+	}
+	// Redirect to the prompt, or hand the challenge to the client. Clients
+	// asking for JSON get the URL to open and the ID to poll instead of a
+	// redirect; the redirect carries the ID in a header.
+	w.Header().Set("X-Request-Id", result.state)
+	if result.challenge.RedirectURL != "" {
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "pending", "id": result.state, "url": result.challenge.RedirectURL})
+			return
+		}
+		http.Redirect(w, r, result.challenge.RedirectURL, http.StatusFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"state": result.state, "challenge": result.challenge.Data})
+}
+
+// handleCallback completes redirect based challenges (Duo, OIDC). It is
+// the end of a browser flow, so the result is rendered as a page; API
+// clients learn it from /requests/{id}.
+func (s *server) handleCallback(w http.ResponseWriter, r *http.Request) {
+	// Step 7: Grab the state and code variables from the callback URL parameters
+	code := r.URL.Query().Get("duo_code")
+	if code == "" {
+		code = r.URL.Query().Get("code")
+	}
+	_, result, err := s.resumeAction(r, AuthResponse{State: r.URL.Query().Get("state"), Code: code})
+	s.renderResult(w, result, err)
+}
+
+// handleVerify completes challenges without a redirect (TOTP, WebAuthn).
+func (s *server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST allowed")
+		return
+	}
+	var resp AuthResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request")
+		return
+	}
+	_, result, err := s.resumeAction(r, resp)
+	s.writeResult(w, result, err)
+}
+
+func (s *server) writeResult(w http.ResponseWriter, result actionResult, err error) {
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if result.approval != "" {
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "pending_approval", "id": result.approval, "message": result.message})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "message": result.message})
+}
+
+// handleRequest reports on a request that needed a second factor: GET
+// /requests/{id}, where id is the one returned with the challenge, or the
+// approval request it waits for. The status is pending, approved, denied,
+// executed or failed.
+func (s *server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET allowed")
+		return
+	}
+	client := s.apiClient(w, r)
+	if client == nil {
+		return
+	}
+	st, owner, ok := s.requests.get(r.PathValue("id"))
+	if !ok || owner != client.Name {
+		writeError(w, http.StatusNotFound, codeRequestNotFound, "Request not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// handleRequestEvents streams the state of a request as server-sent
+// events: GET /requests/{id}/events. Each change is sent as a "status"
+// event with the body of GET /requests/{id}; the stream ends once the
+// request finished.
+func (s *server) handleRequestEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET allowed")
+		return
+	}
+	client := s.apiClient(w, r)
+	if client == nil {
+		return
+	}
+	id := r.PathValue("id")
+	updates, stop := s.requests.watch(id)
+	defer stop()
+	st, owner, ok := s.requests.get(id)
+	if !ok || owner != client.Name {
+		writeError(w, http.StatusNotFound, codeRequestNotFound, "Request not found")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Streaming unsupported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	send := func(st requestState) bool {
+		body, _ := json.Marshal(st)
+		fmt.Fprintf(w, "event: status\ndata: %s\n\n", body)
+		flusher.Flush()
+		return st.finished()
+	}
+	if send(st) {
+		return
+	}
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case st := <-updates:
+			if send(st) {
+				return
+			}
+		case <-keepalive.C:
+			// A comment keeps proxies from closing an idle stream
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.requests.closing:
+			return
+		}
+	}
+}
+
+// handleApprovals lists the requests waiting for approval: GET /approvals.
+func (s *server) handleApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET allowed")
+		return
+	}
+	if s.apiClient(w, r) == nil {
+		return
+	}
+	list := s.approvals.list()
+	if list == nil {
+		list = []pendingApproval{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"approvals": list})
+}
+
+// handleDecision approves or denies a pending request:
+// POST /approvals/{id}/approve or /approvals/{id}/deny with the approver's
+// user and, for TOTP, code. The approver passes the second factor like for
+// any other action.
+func (s *server) handleDecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST allowed")
+		return
+	}
+	decision := r.PathValue("decision")
+	if decision != "approve" && decision != "deny" {
+		writeError(w, http.StatusNotFound, codeInvalidRequest, "Unknown decision")
+		return
+	}
+	client := s.apiClient(w, r)
+	if client == nil {
+		return
+	}
+	var req ActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request")
+		return
+	}
+	req.Action, req.Approval = decision, r.PathValue("id")
+	s.respondAction(w, r, client, req)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+const defaultApprovalTTL = time.Hour
+
+var (
+	errApprovalNotFound = errors.New("approval request not found")
+	errSelfApproval     = errors.New("users may not approve their own requests")
+	errAlreadyApproved  = errors.New("already approved")
+	errNotApprover      = errors.New("not an approver")
+)
+
+// ApprovalConfig configures requests that need other users' approval, or a
+// reason, before they are dispatched.
+type ApprovalConfig struct {
+	// TTL is how long a request waits for its approvals.
+	TTL      string           `json:"ttl,omitempty"`
+	Policies []ApprovalPolicy `json:"policies,omitempty"`
+}
+
+// ApprovalPolicy applies to requests matching Hosts, Accounts and Actions;
+// empty lists match everything, except Actions which defaults to unlock and
+// extend. The first matching policy applies.
+type ApprovalPolicy struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	Accounts []string `json:"accounts,omitempty"`
+	Actions  []string `json:"actions,omitempty"`
+	// Required approvals must come from Approvers other than the requester.
+	Approvers []string `json:"approvers,omitempty"`
+	Required  int      `json:"required,omitempty"`
+	// RequireReason makes the reason mandatory. ReasonPattern is a regular
+	// expression it must match, e.g. a ticket ID like "^OPS-[0-9]+".
+	RequireReason bool   `json:"requireReason,omitempty"`
+	ReasonPattern string `json:"reasonPattern,omitempty"`
+
+	reasonRe *regexp.Regexp
+}
+
+func (p *ApprovalPolicy) validate() error {
+	if len(p.Actions) == 0 {
+		p.Actions = []string{"unlock", "extend"}
+	}
+	if p.Required < 0 || p.Required > len(p.Approvers) {
+		return fmt.Errorf("required must be between 0 and the number of approvers")
+	}
+	if p.ReasonPattern != "" {
+		re, err := regexp.Compile(p.ReasonPattern)
+		if err != nil {
+			return fmt.Errorf("invalid reasonPattern: %w", err)
+		}
+		p.reasonRe = re
+		p.RequireReason = true
+	}
+	return nil
+}
+
+// matches reports whether the policy applies to req. A request without an
+// account targets the daemon's default user, which could be any account.
+func (p *ApprovalPolicy) matches(req ActionRequest) bool {
+	return slices.Contains(p.Actions, req.Action) &&
+		(len(p.Hosts) == 0 || slices.Contains(p.Hosts, req.Host)) &&
+		(len(p.Accounts) == 0 || req.Account == "" || slices.Contains(p.Accounts, req.Account))
+}
+
+// reasonProblem describes what is wrong with the reason of req, if anything.
+func (p *ApprovalPolicy) reasonProblem(req ActionRequest) string {
+	switch {
+	case p.RequireReason && req.Reason == "":
+		return "Missing reason"
+	case p.reasonRe != nil && !p.reasonRe.MatchString(req.Reason):
+		return "Reason must match " + p.ReasonPattern
+	}
+	return ""
+}
+
+// pendingApproval is a request waiting for approvals.
+type pendingApproval struct {
+	ID        string        `json:"id"`
+	Request   ActionRequest `json:"request"`
+	Approvals []string      `json:"approvals"`
+	Required  int           `json:"required"`
+	Created   time.Time     `json:"created"`
+
+	ip     netip.Addr
+	policy *ApprovalPolicy
+	// authUser passed the requester's second factor; it is empty for
+	// fail-open requests.
+	authUser string
+}
+
+// approvalSettings are the settings of an approvalQueue a reload may
+// change.
+type approvalSettings struct {
+	ttl      time.Duration
+	policies []ApprovalPolicy
+}
+
+// approvalQueue holds pending approvals in memory. It is safe for concurrent
+// use; requests expire after ttl.
+type approvalQueue struct {
+	mu      sync.Mutex
+	pending map[string]*pendingApproval
+	approvalSettings
+}
+
+func parseApprovalSettings(config ApprovalConfig) (approvalSettings, error) {
+	a := approvalSettings{ttl: defaultApprovalTTL, policies: slices.Clone(config.Policies)}
+	if config.TTL != "" {
+		d, err := time.ParseDuration(config.TTL)
+		if err != nil {
+			return a, fmt.Errorf("invalid ttl: %w", err)
+		}
+		a.ttl = d
+	}
+	for i := range a.policies {
+		if err := a.policies[i].validate(); err != nil {
+			return a, fmt.Errorf("policy %d: %w", i, err)
+		}
+	}
+	return a, nil
+}
+
+func newApprovalQueue(config ApprovalConfig) (*approvalQueue, error) {
+	a, err := parseApprovalSettings(config)
+	if err != nil {
+		return nil, err
+	}
+	q := &approvalQueue{pending: map[string]*pendingApproval{}, approvalSettings: a}
+	go func() {
+		for range time.Tick(sessionSweepInterval) {
+			q.sweep()
+		}
+	}()
+	return q, nil
+}
+
+// setSettings applies a to the queue. Pending requests keep the policy
+// they were queued under.
+func (q *approvalQueue) setSettings(a approvalSettings) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.approvalSettings = a
+}
+
+// policyFor returns a copy of the policy that applies to req, or nil. It
+// is a copy so a reload can't change it under a pending request.
+func (q *approvalQueue) policyFor(req ActionRequest) *ApprovalPolicy {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, p := range q.policies {
+		if p.matches(req) {
+			return &p
+		}
+	}
+	return nil
+}
+
+func (q *approvalQueue) add(p *pendingApproval) error {
+	id, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	p.ID, p.Created = id, time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending[id] = p
+	pendingApprovals.Set(float64(len(q.pending)))
+	return nil
+}
+
+// get returns a copy of the pending approval id.
+func (q *approvalQueue) get(id string) (pendingApproval, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p, ok := q.pending[id]
+	if !ok || time.Since(p.Created) >= q.ttl {
+		return pendingApproval{}, false
+	}
+	return *p, true
+}
+
+// list returns the pending approvals, oldest first.
+func (q *approvalQueue) list() []pendingApproval {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var list []pendingApproval
+	for _, p := range q.pending {
+		if time.Since(p.Created) < q.ttl {
+			list = append(list, *p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// decide records the decision of approver on id. A denial, or the last
+// required approval, removes the request from the queue; done reports that
+// it has been decided.
+func (q *approvalQueue) decide(id, approver string, approve bool) (p pendingApproval, done bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending, ok := q.pending[id]
+	if !ok || time.Since(pending.Created) >= q.ttl {
+		return pendingApproval{}, false, errApprovalNotFound
+	}
+	switch {
+	case approver == pending.Request.User:
+		return *pending, false, errSelfApproval
+	case !slices.Contains(pending.policy.Approvers, approver):
+		return *pending, false, errNotApprover
+	case slices.Contains(pending.Approvals, approver):
+		return *pending, false, errAlreadyApproved
+	}
+	if approve {
+		pending.Approvals = append(pending.Approvals, approver)
+	}
+	if !approve || len(pending.Approvals) >= pending.Required {
+		delete(q.pending, id)
+		pendingApprovals.Set(float64(len(q.pending)))
+		return *pending, true, nil
+	}
+	return *pending, false, nil
+}
+
+func (q *approvalQueue) sweep() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, p := range q.pending {
+		if time.Since(p.Created) >= q.ttl {
+			log.Printf("Approval request %s of %s expired", id, p.Request.User)
+			delete(q.pending, id)
+			notifyApproval("approval_expired", *p, "")
+		}
+	}
+	pendingApprovals.Set(float64(len(q.pending)))
+}
+
+// notifyApproval fires the hooks for an approval event. approver is the
+// user that decided, if any.
+func notifyApproval(event string, p pendingApproval, approver string) {
+	approvalEvents.WithLabelValues(event).Inc()
+	e := sshlocker.Event{
+		Event:      event,
+		Host:       p.Request.Host,
+		User:       p.Request.Account,
+		Duration:   p.Request.Duration,
+		RemoteIP:   p.ip.String(),
+		AuthUser:   p.Request.User,
+		Reason:     p.Request.Reason,
+		Client:     p.Request.Client,
+		RequestID:  p.ID,
+		ApprovedBy: p.Approvals,
+	}
+	if event == "approval_denied" {
+		e.Error = "denied by " + approver
+	}
+	notifier.Load().Notify(e)
+}
+
+// requestApproval queues req until policy's approvals are given.
+func (s *server) requestApproval(ip netip.Addr, req ActionRequest, authUser string, policy *ApprovalPolicy) (actionResult, error) {
+	// The inline TOTP code has been used and must not be listed
+	req.Code = ""
+	p := &pendingApproval{Request: req, Approvals: []string{}, Required: policy.Required, ip: ip, policy: policy, authUser: authUser}
+	if err := s.approvals.add(p); err != nil {
+		log.Printf("Error queueing approval: %v", err)
+		return actionResult{}, newAPIError(http.StatusInternalServerError, codeInternal, "Internal error")
+	}
+	log.Printf("Action %s for user %s on %s from IP %s waits for %d approval(s) as request %s",
+		req.Action, req.User, req.Host, ip, policy.Required, p.ID)
+	requestsTotal.WithLabelValues(req.Action, "approval_pending").Inc()
+	notifyApproval("approval_requested", *p, "")
+	return actionResult{
+		message:  fmt.Sprintf("Waiting for %d approval(s)", policy.Required),
+		approval: p.ID,
+	}, nil
+}
+
+// decideApproval applies an approve or deny action by req.User, who passed
+// the second factor, and dispatches the request once it is approved.
+func (s *server) decideApproval(req ActionRequest) (actionResult, error) {
+	approve := req.Action == "approve"
+	p, done, err := s.approvals.decide(req.Approval, req.User, approve)
+	switch {
+	case errors.Is(err, errApprovalNotFound):
+		return actionResult{}, newAPIError(http.StatusNotFound, codeApprovalNotFound, "Approval request not found")
+	case err != nil:
+		log.Printf("Rejected %s of request %s by %s: %v", req.Action, req.Approval, req.User, err)
+		requestsTotal.WithLabelValues(req.Action, "forbidden").Inc()
+		return actionResult{}, newAPIError(http.StatusForbidden, codeForbidden, err.Error())
+	}
+	requestsTotal.WithLabelValues(req.Action, "ok").Inc()
+
+	// The request that queued p follows its decisions
+	requester := s.requests.forApproval(p.ID)
+	if !approve {
+		log.Printf("Request %s denied by %s", p.ID, req.User)
+		notifyApproval("approval_denied", p, req.User)
+		s.requests.set(requester, statusDenied, "Denied by "+req.User, "")
+		return actionResult{message: "Request denied"}, nil
+	}
+	log.Printf("Request %s approved by %s", p.ID, req.User)
+	if !done {
+		notifyApproval("approval_granted", p, req.User)
+		message := fmt.Sprintf("Approved, waiting for %d more approval(s)", p.Required-len(p.Approvals))
+		s.requests.set(requester, statusPending, message, "")
+		return actionResult{message: message, approval: p.ID}, nil
+	}
+	notifyApproval("approval_approved", p, req.User)
+	s.requests.set(requester, statusApproved, "", "")
+	p.Request.ApprovedBy = p.Approvals
+	result, err := s.dispatch(p.ip, p.Request, p.authUser)
+	s.requests.finish(requester, result, err)
+	return result, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestApprovalPolicyFor(t *testing.T) {
+	q, err := newApprovalQueue(ApprovalConfig{Policies: []ApprovalPolicy{
+		{Accounts: []string{"root"}, Approvers: []string{"bob"}, Required: 1},
+		{RequireReason: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		req      ActionRequest
+		required int
+		reason   bool
+		none     bool
+	}{
+		{"first match", ActionRequest{Action: "unlock", Account: "root"}, 1, false, false},
+		{"fallthrough", ActionRequest{Action: "extend", Account: "alice"}, 0, true, false},
+		{"other action", ActionRequest{Action: "lock", Account: "root"}, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := q.policyFor(tt.req)
+			if tt.none {
+				if p != nil {
+					t.Errorf("policyFor = %+v, want none", p)
+				}
+				return
+			}
+			if p == nil || p.Required != tt.required || p.RequireReason != tt.reason {
+				t.Errorf("policyFor = %+v, want required %d, reason %v", p, tt.required, tt.reason)
+			}
+		})
+	}
+
+	// The policy handed out is a copy a reload doesn't change; run with
+	// -race to check policies are read under the lock
+	req := ActionRequest{Action: "unlock", Account: "root"}
+	held := q.policyFor(req)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			q.policyFor(req)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		a, err := parseApprovalSettings(ApprovalConfig{Policies: []ApprovalPolicy{{Approvers: []string{"carol", "dave"}, Required: 2}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.setSettings(a)
+	}
+	wg.Wait()
+	if held.Required != 1 || held.Approvers[0] != "bob" {
+		t.Errorf("held policy changed by a reload: %+v", held)
+	}
+	if p := q.policyFor(req); p == nil || p.Required != 2 {
+		t.Errorf("policyFor after reload = %+v, want required 2", p)
+	}
+}
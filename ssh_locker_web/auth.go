@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+const (
+	authDuo      = "duo"
+	authTOTP     = "totp"
+	authWebAuthn = "webauthn"
+	authOIDC     = "oidc"
+)
+
+var (
+	// errAuthDenied is returned by Verify when the user failed the second factor.
+	errAuthDenied = errors.New("authentication denied")
+	// errAuthInvalid is returned for malformed answers, e.g. a missing code.
+	errAuthInvalid = errors.New("invalid authentication response")
+	// errAuthUnavailable is returned when the backend can't be reached.
+	errAuthUnavailable = errors.New("authentication backend unavailable")
+)
+
+// Authenticator is a second-factor backend that must be passed before an
+// action is dispatched to ssh_locker.
+type Authenticator interface {
+	// Name identifies the backend in logs and metrics.
+	Name() string
+	// HealthCheck reports whether the backend can authenticate users.
+	HealthCheck() error
+	// Begin starts a challenge for the session. The session is stored
+	// after Begin returns, so backends may keep their state in s.data.
+	Begin(s *Session) (Challenge, error)
+	// Verify checks the user's answer to the challenge. It returns
+	// errAuthDenied when the user failed the second factor, errAuthInvalid
+	// for malformed answers and errAuthUnavailable when the backend is down.
+	Verify(s *Session, resp AuthResponse) error
+}
+
+// Challenge tells the client how to pass the second factor: either visit
+// RedirectURL, or answer Data by posting an AuthResponse to /verify.
+type Challenge struct {
+	RedirectURL string `json:"url,omitempty"`
+	Data        any    `json:"challenge,omitempty"`
+}
+
+// AuthResponse is the user's answer to a challenge, received on a callback
+// URL or posted to /verify.
+type AuthResponse struct {
+	State     string             `json:"state"`
+	Code      string             `json:"code,omitempty"`
+	Assertion *webauthnAssertion `json:"assertion,omitempty"`
+}
+
+func newAuthenticator(config Config) (Authenticator, error) {
+	switch config.Authenticator {
+	case "", authDuo:
+		return newDuoAuthenticator(config)
+	case authTOTP:
+		if config.TOTP == nil {
+			return nil, fmt.Errorf("missing totp config")
+		}
+		return newTOTPAuthenticator(*config.TOTP)
+	case authWebAuthn:
+		if config.WebAuthn == nil {
+			return nil, fmt.Errorf("missing webauthn config")
+		}
+		return newWebAuthnAuthenticator(*config.WebAuthn)
+	case authOIDC:
+		if config.OIDC == nil {
+			return nil, fmt.Errorf("missing oidc config")
+		}
+		return newOIDCAuthenticator(*config.OIDC)
+	default:
+		return nil, fmt.Errorf("unknown authenticator %q", config.Authenticator)
+	}
+}
+
+// randomString returns n random bytes encoded as unpadded base64url.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
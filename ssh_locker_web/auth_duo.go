@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/duosecurity/duo_universal_golang/duouniversal"
+)
+
+// duoTimeout bounds a call to the Duo API, so a hanging Duo counts as
+// unavailable.
+const duoTimeout = 10 * time.Second
+
+// duoAuthenticator redirects users to the Duo Universal Prompt.
+type duoAuthenticator struct {
+	client *duouniversal.Client
+}
+
+// duoStatusError is a non-200 answer of the Duo API. The Duo client only
+// reports the status text, so duoTransport returns it instead of the
+// response.
+type duoStatusError struct {
+	code   int
+	status string
+}
+
+func (e *duoStatusError) Error() string { return "duo api: " + e.status }
+
+type duoTransport struct {
+	base http.RoundTripper
+}
+
+func (t duoTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &duoStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return resp, nil
+}
+
+// newDuoHTTPClient talks to Duo over TLS only, like the Duo client's own
+// transport.
+func newDuoHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: duoTimeout,
+		Transport: duoTransport{base: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return nil, errors.New("duo api must be reached over https")
+			},
+			DialTLSContext: (&tls.Dialer{Config: &tls.Config{MinVersion: tls.VersionTLS12}}).DialContext,
+		}},
+	}
+}
+
+func newDuoAuthenticator(config Config) (*duoAuthenticator, error) {
+	client, err := duouniversal.NewClient(config.ClientId, config.ClientSecret, config.ApiHost, config.RedirectUri,
+		duouniversal.WithHTTPClient(newDuoHTTPClient()))
+	if err != nil {
+		return nil, err
+	}
+	return &duoAuthenticator{client: client}, nil
+}
+
+func (a *duoAuthenticator) Name() string { return authDuo }
+
+func (a *duoAuthenticator) HealthCheck() error {
+	_, err := a.client.HealthCheck()
+	return err
+}
+
+func (a *duoAuthenticator) Begin(s *Session) (Challenge, error) {
+	url, err := a.client.CreateAuthURL(s.username, s.state)
+	if err != nil {
+		return Challenge{}, err
+	}
+	return Challenge{RedirectURL: url}, nil
+}
+
+// Verify exchanges the duo_code for the authentication result.
+func (a *duoAuthenticator) Verify(s *Session, resp AuthResponse) error {
+	if resp.Code == "" {
+		return errAuthInvalid
+	}
+	authToken, err := a.client.ExchangeAuthorizationCodeFor2faResult(resp.Code, s.username)
+	if err != nil {
+		return classifyDuoError(err)
+	}
+	if authToken.AuthResult.Status != "allow" {
+		return errAuthDenied
+	}
+	return nil
+}
+
+// classifyDuoError maps errors of the Duo client: 5xx and 429 responses and
+// transport failures mean Duo is unavailable. Anything else, e.g. a rejected
+// code or a token that fails validation, is a denied authentication, so an
+// unexpected error can't trigger the fail-open policy.
+func classifyDuoError(err error) error {
+	var statusErr *duoStatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.code >= 500 || statusErr.code == http.StatusTooManyRequests {
+			return fmt.Errorf("%w: %v", errAuthUnavailable, err)
+		}
+		return fmt.Errorf("%w: %v", errAuthDenied, err)
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	return fmt.Errorf("%w: %v", errAuthDenied, err)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/duosecurity/duo_universal_golang/duouniversal"
+)
+
+func TestClassifyDuoError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		closed bool
+		err    error
+	}{
+		{"bad code", http.StatusBadRequest, false, errAuthDenied},
+		{"bad client", http.StatusUnauthorized, false, errAuthDenied},
+		{"rate limited", http.StatusTooManyRequests, false, errAuthUnavailable},
+		{"server error", http.StatusServiceUnavailable, false, errAuthUnavailable},
+		{"unreachable", 0, true, errAuthUnavailable},
+		{"bad token", http.StatusOK, false, errAuthDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"access_token":"x","id_token":"not a jwt","expires_in":300,"token_type":"Bearer"}`))
+			}))
+			defer srv.Close()
+			hc := srv.Client()
+			hc.Transport = duoTransport{base: hc.Transport}
+			client, err := duouniversal.NewClient(strings.Repeat("a", 20), strings.Repeat("b", 40),
+				strings.TrimPrefix(srv.URL, "https://"), "https://example.com/callback", duouniversal.WithHTTPClient(hc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.closed {
+				srv.Close()
+			}
+			a := &duoAuthenticator{client: client}
+			if err := a.Verify(&Session{username: "alice"}, AuthResponse{Code: "code"}); !errors.Is(err, tt.err) {
+				t.Errorf("Verify = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDuoHTTPClientRefusesHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	if resp, err := newDuoHTTPClient().Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("plain http request succeeded")
+	}
+}
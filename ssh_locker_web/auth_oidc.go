@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcNonceKey    = "oidcNonce"
+	oidcVerifierKey = "oidcVerifier"
+	oidcTimeout     = 10 * time.Second
+)
+
+// OIDCConfig configures the authorization code flow against an OpenID
+// Connect provider.
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURI  string   `json:"redirectUri"`
+	Scopes       []string `json:"scopes,omitempty"`
+	// UsernameClaim is the ID token claim that must match the user,
+	// "preferred_username" by default.
+	UsernameClaim string `json:"usernameClaim,omitempty"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcAuthenticator redirects users to an OpenID Connect provider and checks
+// the returned ID token.
+type oidcAuthenticator struct {
+	config OIDCConfig
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+}
+
+func newOIDCAuthenticator(config OIDCConfig) (*oidcAuthenticator, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURI == "" {
+		return nil, fmt.Errorf("oidc issuer, clientId and redirectUri are required")
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile"}
+	}
+	return &oidcAuthenticator{config: config}, nil
+}
+
+func (a *oidcAuthenticator) Name() string { return authOIDC }
+
+// discover fetches the provider metadata, caching it once it succeeded.
+func (a *oidcAuthenticator) discover(ctx context.Context) (*oidcDiscovery, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.discovery != nil {
+		return a.discovery, nil
+	}
+	url := strings.TrimSuffix(a.config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery returned %s", resp.Status)
+	}
+	d := &oidcDiscovery{}
+	if err := json.NewDecoder(resp.Body).Decode(d); err != nil {
+		return nil, fmt.Errorf("invalid oidc discovery document: %w", err)
+	}
+	a.discovery = d
+	return d, nil
+}
+
+func (a *oidcAuthenticator) oauth2Config(d *oidcDiscovery) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     a.config.ClientID,
+		ClientSecret: a.config.ClientSecret,
+		RedirectURL:  a.config.RedirectURI,
+		Scopes:       a.config.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  d.AuthorizationEndpoint,
+			TokenURL: d.TokenEndpoint,
+		},
+	}
+}
+
+func (a *oidcAuthenticator) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+	_, err := a.discover(ctx)
+	return err
+}
+
+func (a *oidcAuthenticator) Begin(s *Session) (Challenge, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+	d, err := a.discover(ctx)
+	if err != nil {
+		return Challenge{}, err
+	}
+	nonce, err := randomString(16)
+	if err != nil {
+		return Challenge{}, err
+	}
+	verifier := oauth2.GenerateVerifier()
+	s.data[oidcNonceKey] = nonce
+	s.data[oidcVerifierKey] = verifier
+	url := a.oauth2Config(d).AuthCodeURL(s.state,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("login_hint", s.username),
+	)
+	return Challenge{RedirectURL: url}, nil
+}
+
+// Verify exchanges the authorization code and checks that the ID token was
+// issued for this flow and names the session's user.
+func (a *oidcAuthenticator) Verify(s *Session, resp AuthResponse) error {
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+	if resp.Code == "" {
+		return errAuthInvalid
+	}
+	d, err := a.discover(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	token, err := a.oauth2Config(d).Exchange(ctx, resp.Code, oauth2.VerifierOption(s.data[oidcVerifierKey]))
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil && retrieveErr.Response.StatusCode < 500 {
+		return fmt.Errorf("%w: %v", errAuthDenied, err)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return fmt.Errorf("no id_token in token response")
+	}
+	keys, err := jwk.Fetch(ctx, d.JWKSURI)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	idToken, err := jwt.Parse([]byte(rawIDToken),
+		jwt.WithKeySet(keys),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(a.config.ClientID),
+		jwt.WithClaimValue("nonce", s.data[oidcNonceKey]),
+	)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAuthDenied, err)
+	}
+	username, _ := idToken.Get(a.config.UsernameClaim)
+	if username != s.username {
+		return errAuthDenied
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+// testIssuer is an OpenID Connect provider that answers every code with an
+// ID token holding claims.
+type testIssuer struct {
+	*httptest.Server
+	key    jwk.Key
+	claims map[string]any
+	// status, when set, is returned by the token endpoint instead.
+	status int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.New(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Set(jwk.KeyIDKey, "test")
+	key.Set(jwk.AlgorithmKey, jwa.RS256)
+	pub, err := jwk.PublicKeyOf(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := jwk.NewSet()
+	keys.Add(pub)
+
+	iss := &testIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                iss.URL,
+			AuthorizationEndpoint: iss.URL + "/auth",
+			TokenEndpoint:         iss.URL + "/token",
+			JWKSURI:               iss.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(keys)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if iss.status != 0 {
+			w.WriteHeader(iss.status)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		if r.FormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_request"}`))
+			return
+		}
+		tok := jwt.New()
+		for k, v := range iss.claims {
+			tok.Set(k, v)
+		}
+		signed, err := jwt.Sign(tok, jwa.RS256, iss.key)
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "x", "token_type": "Bearer", "id_token": string(signed)})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func TestOIDCVerify(t *testing.T) {
+	iss := newTestIssuer(t)
+	a, err := newOIDCAuthenticator(OIDCConfig{Issuer: iss.URL, ClientID: "locker", RedirectURI: "https://locker.example.com/oidc-callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(claims map[string]any)
+		status int
+		err    error
+	}{
+		{"valid", nil, 0, nil},
+		{"other user", func(c map[string]any) { c["preferred_username"] = "bob" }, 0, errAuthDenied},
+		{"other nonce", func(c map[string]any) { c["nonce"] = "replayed" }, 0, errAuthDenied},
+		{"other audience", func(c map[string]any) { c[jwt.AudienceKey] = "other" }, 0, errAuthDenied},
+		{"other issuer", func(c map[string]any) { c[jwt.IssuerKey] = "https://evil.example.com" }, 0, errAuthDenied},
+		{"expired", func(c map[string]any) { c[jwt.ExpirationKey] = time.Now().Add(-time.Hour) }, 0, errAuthDenied},
+		{"code rejected", nil, http.StatusBadRequest, errAuthDenied},
+		{"provider failing", nil, http.StatusBadGateway, errAuthUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Session{state: "state", username: "alice", data: map[string]string{}}
+			ch, err := a.Begin(s)
+			if err != nil || ch.RedirectURL == "" {
+				t.Fatalf("Begin = %+v, %v", ch, err)
+			}
+			iss.claims = map[string]any{
+				jwt.IssuerKey:        iss.URL,
+				jwt.AudienceKey:      "locker",
+				jwt.ExpirationKey:    time.Now().Add(time.Minute),
+				"nonce":              s.data[oidcNonceKey],
+				"preferred_username": "alice",
+			}
+			if tt.modify != nil {
+				tt.modify(iss.claims)
+			}
+			iss.status = tt.status
+			if err := a.Verify(s, AuthResponse{State: s.state, Code: "code"}); !errors.Is(err, tt.err) {
+				t.Errorf("Verify = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestOIDCVerifyMissingCode(t *testing.T) {
+	a, err := newOIDCAuthenticator(OIDCConfig{Issuer: "https://issuer.invalid", ClientID: "locker", RedirectURI: "https://locker.example.com/oidc-callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(&Session{username: "alice"}, AuthResponse{}); !errors.Is(err, errAuthInvalid) {
+		t.Errorf("Verify = %v, want %v", err, errAuthInvalid)
+	}
+}
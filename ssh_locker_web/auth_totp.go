@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTPConfig holds the per-user RFC 6238 secrets, base32 encoded as in
+// otpauth:// URIs.
+type TOTPConfig struct {
+	Secrets map[string]string `json:"secrets"`
+	Digits  int               `json:"digits,omitempty"`
+	Period  int               `json:"period,omitempty"`
+	// Skew is the number of periods accepted before and after the current one.
+	Skew int `json:"skew,omitempty"`
+}
+
+// totpAuthenticator verifies time-based one-time passwords. Each code can
+// only be used once.
+type totpAuthenticator struct {
+	secrets map[string][]byte
+	digits  int
+	period  int64
+	skew    int64
+	now     func() time.Time
+
+	mu       sync.Mutex
+	lastUsed map[string]int64
+}
+
+func newTOTPAuthenticator(config TOTPConfig) (*totpAuthenticator, error) {
+	a := &totpAuthenticator{
+		secrets:  map[string][]byte{},
+		digits:   6,
+		period:   30,
+		skew:     1,
+		now:      time.Now,
+		lastUsed: map[string]int64{},
+	}
+	if config.Digits != 0 {
+		a.digits = config.Digits
+	}
+	if config.Period != 0 {
+		a.period = int64(config.Period)
+	}
+	if config.Skew != 0 {
+		a.skew = int64(config.Skew)
+	}
+	if a.digits < 6 || a.digits > 8 {
+		return nil, fmt.Errorf("totp digits must be between 6 and 8")
+	}
+	if a.period <= 0 {
+		return nil, fmt.Errorf("totp period must be positive")
+	}
+	if a.skew <= 0 {
+		return nil, fmt.Errorf("totp skew must be positive")
+	}
+	for user, secret := range config.Secrets {
+		key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+		if err != nil {
+			return nil, fmt.Errorf("totp secret of %s: %w", user, err)
+		}
+		a.secrets[user] = key
+	}
+	return a, nil
+}
+
+// inherit carries the codes spent with prev over to a, so a reload doesn't
+// make them valid again. If the period changed, the last period used is
+// mapped onto the new one that contains its end.
+func (a *totpAuthenticator) inherit(prev *totpAuthenticator) {
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for user, c := range prev.lastUsed {
+		a.lastUsed[user] = ((c+1)*prev.period - 1) / a.period
+	}
+}
+
+func (a *totpAuthenticator) Name() string { return authTOTP }
+
+func (a *totpAuthenticator) HealthCheck() error { return nil }
+
+func (a *totpAuthenticator) Begin(s *Session) (Challenge, error) {
+	if _, ok := a.secrets[s.username]; !ok {
+		return Challenge{}, fmt.Errorf("no totp secret for %s", s.username)
+	}
+	return Challenge{Data: map[string]any{"type": authTOTP, "digits": a.digits}}, nil
+}
+
+func (a *totpAuthenticator) Verify(s *Session, resp AuthResponse) error {
+	if resp.Code == "" {
+		return errAuthInvalid
+	}
+	key, ok := a.secrets[s.username]
+	if !ok || len(resp.Code) != a.digits {
+		return errAuthDenied
+	}
+	counter := a.now().Unix() / a.period
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for c := counter - a.skew; c <= counter+a.skew; c++ {
+		if c <= a.lastUsed[s.username] {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, c, a.digits)), []byte(resp.Code)) == 1 {
+			a.lastUsed[s.username] = c
+			return nil
+		}
+	}
+	return errAuthDenied
+}
+
+// hotp computes the RFC 4226 one-time password for counter.
+func hotp(key []byte, counter int64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
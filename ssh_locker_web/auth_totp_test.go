@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/base32"
+	"errors"
+	"testing"
+	"time"
+)
+
+// rfc6238Key is the SHA-1 secret of the RFC 6238 test vectors.
+var rfc6238Key = []byte("12345678901234567890")
+
+func TestHOTPRFC6238(t *testing.T) {
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		if got := hotp(rfc6238Key, tt.time/30, 8); got != tt.code {
+			t.Errorf("hotp at %d = %s, want %s", tt.time, got, tt.code)
+		}
+	}
+}
+
+func newTestTOTP(t *testing.T, now *time.Time) *totpAuthenticator {
+	t.Helper()
+	a, err := newTOTPAuthenticator(TOTPConfig{
+		Secrets: map[string]string{"alice": base32.StdEncoding.EncodeToString(rfc6238Key)},
+		Digits:  8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return *now }
+	return a
+}
+
+func TestTOTPVerifySkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code := hotp(rfc6238Key, now.Unix()/30, 8)
+	tests := []struct {
+		name  string
+		shift time.Duration
+		err   error
+	}{
+		{"current period", 0, nil},
+		{"one period late", 30 * time.Second, nil},
+		{"one period early", -30 * time.Second, nil},
+		{"two periods late", 60 * time.Second, errAuthDenied},
+		{"two periods early", -60 * time.Second, errAuthDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := now.Add(tt.shift)
+			a := newTestTOTP(t, &at)
+			if err := a.Verify(&Session{username: "alice"}, AuthResponse{Code: code}); !errors.Is(err, tt.err) {
+				t.Errorf("Verify = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTOTPVerifyReplay(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	a := newTestTOTP(t, &now)
+	s := &Session{username: "alice"}
+	counter := now.Unix() / 30
+	if err := a.Verify(s, AuthResponse{Code: hotp(rfc6238Key, counter, 8)}); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := a.Verify(s, AuthResponse{Code: hotp(rfc6238Key, counter, 8)}); !errors.Is(err, errAuthDenied) {
+		t.Errorf("replay = %v, want %v", err, errAuthDenied)
+	}
+	// A code older than the one used is spent too, even within the skew
+	if err := a.Verify(s, AuthResponse{Code: hotp(rfc6238Key, counter-1, 8)}); !errors.Is(err, errAuthDenied) {
+		t.Errorf("older code = %v, want %v", err, errAuthDenied)
+	}
+	if err := a.Verify(s, AuthResponse{Code: hotp(rfc6238Key, counter+1, 8)}); err != nil {
+		t.Errorf("next code: %v", err)
+	}
+}
+
+func TestTOTPVerifyInvalid(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	a := newTestTOTP(t, &now)
+	code := hotp(rfc6238Key, now.Unix()/30, 8)
+	tests := []struct {
+		name string
+		user string
+		code string
+		err  error
+	}{
+		{"missing code", "alice", "", errAuthInvalid},
+		{"wrong length", "alice", code[:6], errAuthDenied},
+		{"unknown user", "bob", code, errAuthDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := a.Verify(&Session{username: tt.user}, AuthResponse{Code: tt.code}); !errors.Is(err, tt.err) {
+				t.Errorf("Verify = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTOTPInherit(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	prev := newTestTOTP(t, &now)
+	s := &Session{username: "alice"}
+	counter := now.Unix() / 30
+	if err := prev.Verify(s, AuthResponse{Code: hotp(rfc6238Key, counter, 8)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reload rebuilds the authenticator; the spent code stays spent
+	a := newTestTOTP(t, &now)
+	a.inherit(prev)
+	if err := a.Verify(s, AuthResponse{Code: hotp(rfc6238Key, counter, 8)}); !errors.Is(err, errAuthDenied) {
+		t.Errorf("replay after reload = %v, want %v", err, errAuthDenied)
+	}
+
+	// With a longer period, the period holding the spent one is spent too
+	long := newTestTOTP(t, &now)
+	long.period = 60
+	long.inherit(prev)
+	if err := long.Verify(s, AuthResponse{Code: hotp(rfc6238Key, now.Unix()/60, 8)}); !errors.Is(err, errAuthDenied) {
+		t.Errorf("overlapping code after reload = %v, want %v", err, errAuthDenied)
+	}
+	if err := long.Verify(s, AuthResponse{Code: hotp(rfc6238Key, now.Unix()/60+1, 8)}); err != nil {
+		t.Errorf("next code after reload: %v", err)
+	}
+}
+
+func TestNewTOTPAuthenticatorInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TOTPConfig
+	}{
+		{"digits", TOTPConfig{Digits: 4}},
+		{"negative period", TOTPConfig{Period: -30}},
+		{"negative skew", TOTPConfig{Skew: -1}},
+		{"secret", TOTPConfig{Secrets: map[string]string{"alice": "not base32!"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTOTPAuthenticator(tt.config); err == nil {
+				t.Error("newTOTPAuthenticator accepted an invalid config")
+			}
+		})
+	}
+}
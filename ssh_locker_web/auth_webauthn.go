@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sync"
+)
+
+const webauthnChallengeKey = "webauthnChallenge"
+
+// WebAuthnConfig lists the relying party and the passkeys registered for
+// each user. Credentials are registered out of band; PublicKey is the PEM
+// encoded SubjectPublicKeyInfo of the credential.
+type WebAuthnConfig struct {
+	RPID        string                          `json:"rpId"`
+	Origin      string                          `json:"origin"`
+	Credentials map[string][]WebAuthnCredential `json:"credentials"`
+}
+
+type WebAuthnCredential struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"publicKey"`
+}
+
+// webauthnAssertion is the base64url encoded result of navigator.credentials.get().
+type webauthnAssertion struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+}
+
+type webauthnCredential struct {
+	id        string
+	publicKey crypto.PublicKey
+}
+
+// webauthnAuthenticator verifies passkey assertions.
+type webauthnAuthenticator struct {
+	rpID        string
+	origin      string
+	credentials map[string][]webauthnCredential
+
+	mu         sync.Mutex
+	signCounts map[string]uint32
+}
+
+func newWebAuthnAuthenticator(config WebAuthnConfig) (*webauthnAuthenticator, error) {
+	if config.RPID == "" || config.Origin == "" {
+		return nil, fmt.Errorf("webauthn rpId and origin are required")
+	}
+	a := &webauthnAuthenticator{
+		rpID:        config.RPID,
+		origin:      config.Origin,
+		credentials: map[string][]webauthnCredential{},
+		signCounts:  map[string]uint32{},
+	}
+	for user, creds := range config.Credentials {
+		for _, c := range creds {
+			block, _ := pem.Decode([]byte(c.PublicKey))
+			if block == nil {
+				return nil, fmt.Errorf("webauthn credential %s of %s: invalid PEM", c.ID, user)
+			}
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("webauthn credential %s of %s: %w", c.ID, user, err)
+			}
+			a.credentials[user] = append(a.credentials[user], webauthnCredential{id: c.ID, publicKey: key})
+		}
+	}
+	return a, nil
+}
+
+func (a *webauthnAuthenticator) Name() string { return authWebAuthn }
+
+func (a *webauthnAuthenticator) HealthCheck() error { return nil }
+
+// Begin returns PublicKeyCredentialRequestOptions for navigator.credentials.get().
+func (a *webauthnAuthenticator) Begin(s *Session) (Challenge, error) {
+	creds := a.credentials[s.username]
+	if len(creds) == 0 {
+		return Challenge{}, fmt.Errorf("no webauthn credentials for %s", s.username)
+	}
+	challenge, err := randomString(32)
+	if err != nil {
+		return Challenge{}, err
+	}
+	s.data[webauthnChallengeKey] = challenge
+	allow := make([]map[string]string, 0, len(creds))
+	for _, c := range creds {
+		allow = append(allow, map[string]string{"type": "public-key", "id": c.id})
+	}
+	return Challenge{Data: map[string]any{
+		"type": authWebAuthn,
+		"publicKey": map[string]any{
+			"challenge":        challenge,
+			"rpId":             a.rpID,
+			"allowCredentials": allow,
+			"userVerification": "preferred",
+			"timeout":          60000,
+		},
+	}}, nil
+}
+
+func (a *webauthnAuthenticator) Verify(s *Session, resp AuthResponse) error {
+	as := resp.Assertion
+	if as == nil {
+		return errAuthInvalid
+	}
+	var cred *webauthnCredential
+	for i, c := range a.credentials[s.username] {
+		if c.id == as.ID {
+			cred = &a.credentials[s.username][i]
+		}
+	}
+	if cred == nil {
+		return errAuthDenied
+	}
+	clientData, err1 := base64.RawURLEncoding.DecodeString(as.ClientDataJSON)
+	authData, err2 := base64.RawURLEncoding.DecodeString(as.AuthenticatorData)
+	sig, err3 := base64.RawURLEncoding.DecodeString(as.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return errAuthInvalid
+	}
+
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(clientData, &cd); err != nil {
+		return errAuthInvalid
+	}
+	if cd.Type != "webauthn.get" || cd.Challenge != s.data[webauthnChallengeKey] || cd.Origin != a.origin {
+		return errAuthDenied
+	}
+
+	// authenticatorData: rpIdHash (32) | flags (1) | signCount (4) | ...
+	if len(authData) < 37 {
+		return errAuthDenied
+	}
+	rpHash := sha256.Sum256([]byte(a.rpID))
+	if !bytes.Equal(authData[:32], rpHash[:]) || authData[32]&0x01 == 0 {
+		return errAuthDenied
+	}
+
+	clientHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), clientHash[:]...)
+	if !verifySignature(cred.publicKey, signed, sig) {
+		return errAuthDenied
+	}
+
+	// A sign count that doesn't increase hints at a cloned authenticator.
+	count := binary.BigEndian.Uint32(authData[33:37])
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if count != 0 && count <= a.signCounts[cred.id] {
+		return errAuthDenied
+	}
+	a.signCounts[cred.id] = count
+	return nil
+}
+
+func verifySignature(key crypto.PublicKey, data, sig []byte) bool {
+	digest := sha256.Sum256(data)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, data, sig)
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"testing"
+)
+
+const (
+	testRPID   = "locker.example.com"
+	testOrigin = "https://locker.example.com"
+)
+
+// testPasskey is a generated passkey that signs assertions like an
+// authenticator.
+type testPasskey struct {
+	id  string
+	key *ecdsa.PrivateKey
+}
+
+func newTestPasskey(t *testing.T) (*testPasskey, *webauthnAuthenticator) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := &testPasskey{id: "cred-1", key: key}
+	a, err := newWebAuthnAuthenticator(WebAuthnConfig{
+		RPID:   testRPID,
+		Origin: testOrigin,
+		Credentials: map[string][]WebAuthnCredential{
+			"alice": {{ID: pk.id, PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk, a
+}
+
+// assert signs the challenge of s for origin with the given sign count.
+func (pk *testPasskey) assert(t *testing.T, s *Session, origin string, count uint32) *webauthnAssertion {
+	t.Helper()
+	clientData, _ := json.Marshal(map[string]string{
+		"type":      "webauthn.get",
+		"challenge": s.data[webauthnChallengeKey],
+		"origin":    origin,
+	})
+	rpHash := sha256.Sum256([]byte(testRPID))
+	authData := append(rpHash[:], 0x01, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:], count)
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, pk.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &webauthnAssertion{
+		ID:                pk.id,
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(sig),
+	}
+}
+
+func beginWebAuthn(t *testing.T, a *webauthnAuthenticator) *Session {
+	t.Helper()
+	s := &Session{username: "alice", data: map[string]string{}}
+	if _, err := a.Begin(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWebAuthnVerify(t *testing.T) {
+	pk, a := newTestPasskey(t)
+	s := beginWebAuthn(t, a)
+	if err := a.Verify(s, AuthResponse{Assertion: pk.assert(t, s, testOrigin, 1)}); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s *Session, as *webauthnAssertion)
+		origin string
+		err    error
+	}{
+		{"wrong origin", nil, "https://evil.example.com", errAuthDenied},
+		{"other challenge", func(s *Session, as *webauthnAssertion) { s.data[webauthnChallengeKey] = "other" }, testOrigin, errAuthDenied},
+		{"unknown credential", func(s *Session, as *webauthnAssertion) { as.ID = "cred-2" }, testOrigin, errAuthDenied},
+		{"bad signature", func(s *Session, as *webauthnAssertion) {
+			as.Signature = base64.RawURLEncoding.EncodeToString([]byte("not a signature"))
+		}, testOrigin, errAuthDenied},
+		{"malformed", func(s *Session, as *webauthnAssertion) { as.ClientDataJSON = "!" }, testOrigin, errAuthInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := beginWebAuthn(t, a)
+			as := pk.assert(t, s, tt.origin, 10)
+			if tt.modify != nil {
+				tt.modify(s, as)
+			}
+			if err := a.Verify(s, AuthResponse{Assertion: as}); !errors.Is(err, tt.err) {
+				t.Errorf("Verify = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestWebAuthnSignCount(t *testing.T) {
+	pk, a := newTestPasskey(t)
+	verify := func(count uint32) error {
+		s := beginWebAuthn(t, a)
+		return a.Verify(s, AuthResponse{Assertion: pk.assert(t, s, testOrigin, count)})
+	}
+	if err := verify(5); err != nil {
+		t.Fatalf("count 5: %v", err)
+	}
+	// A count that doesn't increase hints at a cloned authenticator
+	for _, count := range []uint32{5, 4} {
+		if err := verify(count); !errors.Is(err, errAuthDenied) {
+			t.Errorf("count %d = %v, want %v", count, err, errAuthDenied)
+		}
+	}
+	if err := verify(6); err != nil {
+		t.Errorf("count 6: %v", err)
+	}
+	// Authenticators without a counter always report 0
+	if err := verify(0); err != nil {
+		t.Errorf("count 0: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parsePrefixes parses CIDRs; a bare address is taken as a single host.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			addr, err := netip.ParseAddr(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", c)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", c)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP resolves the address of the client that made r. Forwarding
+// headers are only believed when the connection comes from a trusted proxy;
+// the chain is then walked from the right, skipping trusted proxies, and the
+// first other address is the client. The Forwarded header takes precedence
+// over X-Forwarded-For and X-Real-IP.
+func (s *server) clientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	peer = peer.Unmap()
+	proxies := s.current().proxies
+	if !containsAddr(proxies, peer) {
+		return peer
+	}
+
+	chain := forwardedFor(r.Header.Values("Forwarded"))
+	if chain == nil {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(v, ",") {
+				chain = append(chain, strings.TrimSpace(hop))
+			}
+		}
+	}
+	if chain == nil {
+		if v := strings.TrimSpace(r.Header.Get("X-Real-IP")); v != "" {
+			chain = []string{v}
+		}
+	}
+
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseHop(chain[i])
+		if !ok {
+			// An unparsable hop ends the part of the chain we can trust
+			break
+		}
+		client = addr
+		if !containsAddr(proxies, addr) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedFor returns the for= values of RFC 7239 Forwarded headers, in order.
+func forwardedFor(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					chain = append(chain, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// parseHop parses one forwarded address: "192.0.2.1", "192.0.2.1:80",
+// "2001:db8::1" or "[2001:db8::1]:80". Obfuscated and "unknown" hops fail.
+func parseHop(hop string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(hop); err == nil {
+		return addr.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")); err == nil {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
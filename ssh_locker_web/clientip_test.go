@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParseHop(t *testing.T) {
+	tests := []struct {
+		hop  string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:80", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:80", "2001:db8::1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"unknown", ""},
+		{"_hidden", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		addr, ok := parseHop(tt.hop)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("parseHop(%q) = %v, want failure", tt.hop, addr)
+			}
+			continue
+		}
+		if !ok || addr != netip.MustParseAddr(tt.want) {
+			t.Errorf("parseHop(%q) = %v, %v, want %s", tt.hop, addr, ok, tt.want)
+		}
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"none", nil, nil},
+		{"single", []string{"for=192.0.2.1"}, []string{"192.0.2.1"}},
+		{"quoted IPv6", []string{`for="[2001:db8::1]:80";proto=https`}, []string{"[2001:db8::1]:80"}},
+		{"list", []string{"for=192.0.2.1, For=198.51.100.1;by=10.0.0.1"}, []string{"192.0.2.1", "198.51.100.1"}},
+		{"several headers", []string{"for=192.0.2.1", "for=198.51.100.1"}, []string{"192.0.2.1", "198.51.100.1"}},
+		{"without for", []string{"proto=https;by=10.0.0.1"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forwardedFor(tt.values); !slices.Equal(got, tt.want) {
+				t.Errorf("forwardedFor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parsePrefixes([]string{"10.0.0.1", "10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{}
+	s.settings.Store(&settings{proxies: proxies})
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer forwarding", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"spoofed left of the client", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"only proxies", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.1.2.3"}, "10.1.2.3"},
+		{"unparsable hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, unknown"}, "10.0.0.1"},
+		{"forwarded wins", "10.0.0.1:1234", map[string]string{"Forwarded": `for="[2001:db8::1]:80"`, "X-Forwarded-For": "198.51.100.1"}, "2001:db8::1"},
+		{"real ip", "10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1"},
+		{"mapped peer", "[::ffff:10.0.0.1]:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1"},
+		{"no headers", "10.0.0.1:1234", nil, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/action", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := s.clientIP(r); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("clientIP = %v, want %s", got, tt.want)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("GET", "/action", nil)
+	r.RemoteAddr = "not an address"
+	if got := s.clientIP(r); got.IsValid() {
+		t.Errorf("clientIP of an invalid peer = %v, want none", got)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultClientName names the client created from the legacy accessToken.
+const defaultClientName = "default"
+
+var (
+	errUnknownClient = errors.New("unknown token")
+	errClientRevoked = errors.New("client revoked")
+	errClientExpired = errors.New("client expired")
+	errClientNetwork = errors.New("client network not allowed")
+	errClientCert    = errors.New("client certificate required")
+)
+
+// APIClient is a named API credential. Only the SHA-256 of its token is
+// stored; Users (who pass the second factor), Accounts (whose keys are
+// locked), Actions and Hosts restrict what the client may request and
+// Networks where it may connect from. Empty lists allow everything.
+//
+// A client with a CommonName must present a certificate with that common
+// name, signed by tls.clientCA. Without a TokenHash the certificate alone
+// authenticates it.
+type APIClient struct {
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"tokenHash,omitempty"`
+	CommonName string     `json:"commonName,omitempty"`
+	Users      []string   `json:"users,omitempty"`
+	Accounts   []string   `json:"accounts,omitempty"`
+	Actions    []string   `json:"actions,omitempty"`
+	Hosts      []string   `json:"hosts,omitempty"`
+	Networks   []string   `json:"networks,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	Revoked    bool       `json:"revoked,omitempty"`
+	// MintTokens lets the client mint unlock tokens within its
+	// restrictions.
+	MintTokens bool `json:"mintTokens,omitempty"`
+
+	hash     []byte
+	networks []netip.Prefix
+}
+
+// hashToken returns the hex SHA-256 of token, as stored in tokenHash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadClients validates the configured clients and adds the legacy
+// accessToken as an unrestricted client.
+func loadClients(config Config) ([]*APIClient, error) {
+	var clients []*APIClient
+	names := map[string]bool{}
+	for i := range config.APIClients {
+		c := config.APIClients[i]
+		if c.Name == "" {
+			return nil, fmt.Errorf("api client %d: missing name", i)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("api client %s: duplicate name", c.Name)
+		}
+		names[c.Name] = true
+		if c.TokenHash == "" && c.CommonName == "" {
+			return nil, fmt.Errorf("api client %s: tokenHash or commonName is required", c.Name)
+		}
+		if c.CommonName != "" && (config.TLS.ClientCA == "" || !tlsEnabled(config)) {
+			return nil, fmt.Errorf("api client %s: commonName requires TLS with tls.clientCA", c.Name)
+		}
+		if c.TokenHash != "" {
+			hash, err := hex.DecodeString(strings.TrimPrefix(c.TokenHash, "sha256:"))
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("api client %s: tokenHash must be a hex SHA-256", c.Name)
+			}
+			c.hash = hash
+		}
+		var err error
+		if c.networks, err = parsePrefixes(c.Networks); err != nil {
+			return nil, fmt.Errorf("api client %s: %w", c.Name, err)
+		}
+		clients = append(clients, &c)
+	}
+	if config.AccessToken != "" {
+		if names[defaultClientName] {
+			return nil, fmt.Errorf("api client %s conflicts with accessToken", defaultClientName)
+		}
+		hash, _ := hex.DecodeString(hashToken(config.AccessToken))
+		clients = append(clients, &APIClient{Name: defaultClientName, hash: hash})
+	}
+	return clients, nil
+}
+
+// authenticateClient finds the client whose token was sent in X-Auth-Token
+// or as a bearer token. Every client is compared in constant time. Without
+// a token, the verified client certificate identifies a certificate-only
+// client.
+func authenticateClient(clients []*APIClient, r *http.Request) (*APIClient, error) {
+	token := r.Header.Get("X-Auth-Token")
+	if token == "" {
+		token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	cn := peerCommonName(r)
+	var found *APIClient
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		for _, c := range clients {
+			if subtle.ConstantTimeCompare(sum[:], c.hash) == 1 {
+				found = c
+			}
+		}
+	} else if cn != "" {
+		for _, c := range clients {
+			if c.TokenHash == "" && c.CommonName == cn {
+				found = c
+			}
+		}
+	}
+	switch {
+	case found == nil:
+		return nil, errUnknownClient
+	case found.CommonName != "" && found.CommonName != cn:
+		return found, errClientCert
+	}
+	return found, found.active()
+}
+
+// active returns errClientRevoked or errClientExpired if c may no longer
+// be used.
+func (c *APIClient) active() error {
+	switch {
+	case c.Revoked:
+		return errClientRevoked
+	case c.Expires != nil && time.Now().After(*c.Expires):
+		return errClientExpired
+	}
+	return nil
+}
+
+// peerCommonName returns the common name of the verified client
+// certificate, if any.
+func peerCommonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// client returns the client called name, or nil.
+func (s *server) client(name string) *APIClient {
+	for _, c := range s.current().clients {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// allows reports whether the client may make req. Without an account
+// ssh_locker picks its first managed user, so a client restricted to
+// accounts must name one, except to list the host.
+func (c *APIClient) allows(req ActionRequest) bool {
+	if len(c.Hosts) > 0 && !slices.Contains(c.Hosts, req.Host) {
+		return false
+	}
+	if len(c.Users) > 0 && !slices.Contains(c.Users, req.User) {
+		return false
+	}
+	if len(c.Accounts) > 0 && !slices.Contains(c.Accounts, req.Account) && !(req.Action == "list" && req.Account == "") {
+		return false
+	}
+	if len(c.Actions) > 0 && !slices.Contains(c.Actions, req.Action) {
+		return false
+	}
+	return true
+}
+
+// allowsIP reports whether the client may connect from ip.
+func (c *APIClient) allowsIP(ip netip.Addr) bool {
+	return len(c.networks) == 0 || containsAddr(c.networks, ip)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Error codes of the JSON error schema.
+const (
+	codeMethodNotAllowed = "method_not_allowed"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeInvalidRequest   = "invalid_request"
+	codeSessionNotFound  = "session_not_found"
+	codeApprovalNotFound = "approval_not_found"
+	codeRequestNotFound  = "request_not_found"
+	codeRequestExpired   = "request_expired"
+	codeInvalidToken     = "invalid_token"
+	codeTooManyPending   = "too_many_pending"
+	codeRateLimited      = "rate_limited"
+	codeLockedOut        = "locked_out"
+	codeAuthUnavailable  = "auth_unavailable"
+	codeAuthDenied       = "auth_denied"
+	codeAuthError        = "auth_error"
+	codeActionFailed     = "action_failed"
+	codeSocketError      = "socket_error"
+	codeInternal         = "internal_error"
+)
+
+// errorResponse is the body of every error returned by the API:
+//
+//	{"error": {"code": "auth_denied", "message": "Authentication failed"}}
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		status, body = http.StatusInternalServerError, []byte(`{"error":{"code":"internal_error","message":"Internal error"}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorResponse{Error: errorBody{Code: code, Message: message}})
+}
+
+// writeAPIError writes err using its status and code if it is an apiError.
+func writeAPIError(w http.ResponseWriter, err error) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(apiErr.retryAfter.Seconds()+1)))
+	}
+	status, body := errorStatus(err)
+	writeJSON(w, status, body)
+}
+
+// errorStatus returns the status and body writeAPIError sends for err.
+func errorStatus(err error) (int, errorResponse) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.status, errorResponse{Error: errorBody{Code: apiErr.code, Message: apiErr.message}}
+	}
+	return http.StatusInternalServerError, errorResponse{Error: errorBody{Code: codeInternal, Message: "Internal error"}}
+}
+
+// authError classifies a failed second factor.
+func authError(err error) *apiError {
+	switch {
+	case errors.Is(err, errAuthDenied):
+		return newAPIError(http.StatusUnauthorized, codeAuthDenied, "Authentication failed")
+	case errors.Is(err, errAuthInvalid):
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid authentication response")
+	case errors.Is(err, errAuthUnavailable):
+		return newAPIError(http.StatusServiceUnavailable, codeAuthUnavailable, authUnavailable)
+	default:
+		return newAPIError(http.StatusBadGateway, codeAuthError, "Authentication error")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+const (
+	failClosed = "closed"
+	failOpen   = "open"
+)
+
+// FailPolicyConfig decides what happens when the second factor backend is
+// down: "closed" rejects the request, "open" performs it without the second
+// factor. Groups override the default for their users; the first match wins.
+// Approving or denying a request always fails closed.
+type FailPolicyConfig struct {
+	Default string            `json:"default,omitempty"`
+	Groups  []FailPolicyGroup `json:"groups,omitempty"`
+}
+
+type FailPolicyGroup struct {
+	Name   string   `json:"name"`
+	Users  []string `json:"users"`
+	Policy string   `json:"policy"`
+}
+
+func (c FailPolicyConfig) validate() error {
+	if c.Default != "" && c.Default != failClosed && c.Default != failOpen {
+		return fmt.Errorf("invalid fail policy %q", c.Default)
+	}
+	for _, g := range c.Groups {
+		if g.Policy != failClosed && g.Policy != failOpen {
+			return fmt.Errorf("fail policy group %s: invalid policy %q", g.Name, g.Policy)
+		}
+	}
+	return nil
+}
+
+// policyFor returns the fail policy of user, failing closed by default.
+func (c FailPolicyConfig) policyFor(user string) string {
+	for _, g := range c.Groups {
+		if slices.Contains(g.Users, user) {
+			return g.Policy
+		}
+	}
+	if c.Default == "" {
+		return failClosed
+	}
+	return c.Default
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+// HostConfig is an ssh_locker daemon managed by this instance. It is reached
+// either over a unix socket, local or forwarded over SSH, or over the
+// daemon's mTLS agent listener at Address.
+type HostConfig struct {
+	// Name must match the daemon's agent name (its hostname by default);
+	// requests are bound to it and refused by any other daemon.
+	Name    string `json:"name"`
+	Socket  string `json:"socket,omitempty"`
+	Address string `json:"address,omitempty"`
+	// CA verifies the daemon's certificate, Cert and Key authenticate this
+	// instance to it.
+	CA         string `json:"ca,omitempty"`
+	Cert       string `json:"cert,omitempty"`
+	Key        string `json:"key,omitempty"`
+	ServerName string `json:"serverName,omitempty"`
+}
+
+// host is a registered daemon.
+type host struct {
+	name  string
+	agent sshlocker.Agent
+	// bound hosts send their name with each request. The legacy
+	// socketPath host is not bound because the daemon's name is unknown.
+	bound bool
+}
+
+// loadHosts builds the host registry. Without hosts the instance manages
+// the daemon at socketPath, as before hosts were introduced.
+func loadHosts(config Config) ([]host, error) {
+	if len(config.Hosts) == 0 {
+		path := sshlocker.DefaultSocketPath
+		if config.SocketPath != "" {
+			path = config.SocketPath
+		}
+		return []host{{name: "local", agent: sshlocker.Agent{Network: "unix", Address: path}}}, nil
+	}
+
+	var hosts []host
+	seen := map[string]bool{}
+	for i, hc := range config.Hosts {
+		if hc.Name == "" || strings.ContainsAny(hc.Name, " /") {
+			return nil, fmt.Errorf("host %d: invalid name %q", i, hc.Name)
+		}
+		if seen[hc.Name] {
+			return nil, fmt.Errorf("host %s: duplicate name", hc.Name)
+		}
+		seen[hc.Name] = true
+
+		h := host{name: hc.Name, bound: true}
+		switch {
+		case hc.Socket != "" && hc.Address != "":
+			return nil, fmt.Errorf("host %s: set socket or address, not both", hc.Name)
+		case hc.Socket != "":
+			h.agent = sshlocker.Agent{Network: "unix", Address: hc.Socket}
+		case hc.Address != "":
+			serverName := hc.ServerName
+			if serverName == "" {
+				serverName = hc.Name
+			}
+			tlsConfig, err := sshlocker.ClientTLSConfig(hc.CA, hc.Cert, hc.Key, serverName)
+			if err != nil {
+				return nil, fmt.Errorf("host %s: %w", hc.Name, err)
+			}
+			h.agent = sshlocker.Agent{Network: "tcp", Address: hc.Address, TLS: tlsConfig}
+		default:
+			return nil, fmt.Errorf("host %s: socket or address required", hc.Name)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+// host looks up a registered host. The host may be omitted when only one is
+// registered.
+func (s *server) host(name string) (host, bool) {
+	hosts := s.current().hosts
+	if name == "" && len(hosts) == 1 {
+		return hosts[0], true
+	}
+	for _, h := range hosts {
+		if h.name == name {
+			return h, true
+		}
+	}
+	return host{}, false
+}
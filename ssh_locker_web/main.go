@@ -1,19 +1,19 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
-	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 
-	"github.com/duosecurity/duo_universal_golang/duouniversal"
+	"github.com/a13labs/systools/internal/sshlocker"
 )
 
-const duoUnavailable = "Duo unavailable"
+const authUnavailable = "Second factor unavailable"
 const defaultConfig = "config.json"
 
 type Config struct {
@@ -26,198 +26,208 @@ type Config struct {
 	Port         string `json:"port,omitempty"`
 	TLS_Cert     string `json:"tlsCert,omitempty"`
 	TLS_Key      string `json:"tlsKey,omitempty"`
+	MetricsAddr  string `json:"metricsAddr,omitempty"`
+	// TLS tunes HTTPS and enables client certificates and ACME.
+	TLS TLSConfig `json:"tls,omitempty"`
+	// Authenticator selects the second factor: duo (default), totp, webauthn or oidc.
+	Authenticator string           `json:"authenticator,omitempty"`
+	TOTP          *TOTPConfig      `json:"totp,omitempty"`
+	WebAuthn      *WebAuthnConfig  `json:"webauthn,omitempty"`
+	OIDC          *OIDCConfig      `json:"oidc,omitempty"`
+	APIClients    []APIClient      `json:"apiClients,omitempty"`
+	Sessions      SessionConfig    `json:"sessions,omitempty"`
+	FailPolicy    FailPolicyConfig `json:"failPolicy,omitempty"`
+	// Hosts lists the daemons this instance manages. Without hosts it
+	// manages the daemon at SocketPath.
+	Hosts []HostConfig `json:"hosts,omitempty"`
+	// TrustedProxies lists the CIDRs of reverse proxies whose Forwarded,
+	// X-Forwarded-For and X-Real-IP headers are believed.
+	TrustedProxies []string        `json:"trustedProxies,omitempty"`
+	RateLimit      RateLimitConfig `json:"rateLimit,omitempty"`
+	Approvals      ApprovalConfig  `json:"approvals,omitempty"`
+	// Hooks are notified of approval requests and decisions.
+	Hooks []sshlocker.HookConfig `json:"hooks,omitempty"`
+	// UnlockTokens enables single-use unlock tokens for machine clients.
+	UnlockTokens *UnlockTokenConfig `json:"unlockTokens,omitempty"`
 }
 
 type ActionRequest struct {
-	User   string `json:"user"`
-	Action string `json:"action"`
+	User    string `json:"user"`
+	Action  string `json:"action"`
+	Account string `json:"account,omitempty"`
+	// Host selects the managed daemon; it may be omitted with a single host.
+	Host     string `json:"host,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// Approval is the request an approve or deny action decides.
+	Approval string `json:"approval,omitempty"`
+	// Code answers a TOTP challenge inline, without a /verify round trip,
+	// or is the recovery code of a recover action.
+	Code string `json:"code,omitempty"`
+	// FailOpen is set when the action runs without the second factor
+	// because the backend is down and the user's fail policy is open.
+	FailOpen bool `json:"-"`
+	// Client is the name of the API client that made the request.
+	Client string `json:"-"`
+	// ApprovedBy lists the users that approved the request.
+	ApprovedBy []string `json:"-"`
+	// TokenID is the unlock token the request was made with.
+	TokenID string `json:"-"`
 }
 
-type Session struct {
-	duoState    string
-	duoUsername string
-	request     ActionRequest
-}
-
-var currentSessions map[string]Session
-var socketPath = "/var/run/ssh_locker.sock"
+// notifier is swapped on reload while approvals may be expiring.
+var notifier atomic.Pointer[sshlocker.Notifier]
 
 func main() {
 
 	var configFile string
+	var tokenToHash string
 
 	flag.StringVar(&configFile, "c", defaultConfig, "Path to the config file")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "How long to wait for requests in flight on shutdown")
+	flag.StringVar(&tokenToHash, "hash-token", "", "Print the tokenHash of an API client token and exit")
 	flag.Parse()
 
-	file, err := os.Open(configFile)
-	config := Config{}
+	if tokenToHash != "" {
+		fmt.Println(hashToken(tokenToHash))
+		return
+	}
+
+	config, err := loadConfig(configFile)
 	if err != nil {
-		log.Fatal("can't open config file: ", err)
+		log.Fatal(err)
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
+	// Step 1: Create the second factor backend
+	auth, err := newAuthenticator(config)
 	if err != nil {
-		log.Fatal("can't decode config JSON: ", err)
+		log.Fatal("Error parsing config: ", err)
+	}
+	if err := config.FailPolicy.validate(); err != nil {
+		log.Fatal("Error parsing config: ", err)
 	}
-	// Step 1: Create a Duo client
-	duoClient, err := duouniversal.NewClient(config.ClientId, config.ClientSecret, config.ApiHost, config.RedirectUri)
+	clients, err := loadClients(config)
 	if err != nil {
 		log.Fatal("Error parsing config: ", err)
 	}
+	if len(clients) == 0 {
+		log.Fatal("Error parsing config: no accessToken or apiClients")
+	}
 
-	currentSessions = make(map[string]Session)
-	if config.SocketPath != "" {
-		socketPath = config.SocketPath
+	sessions, err := newSessionStore(config.Sessions)
+	if err != nil {
+		log.Fatal("Error parsing config: ", err)
 	}
-	if config.Port == "" && config.TLS_Cert == "" && config.TLS_Key == "" {
+	hosts, err := loadHosts(config)
+	if err != nil {
+		log.Fatal("Error parsing config: ", err)
+	}
+	proxies, err := parsePrefixes(config.TrustedProxies)
+	if err != nil {
+		log.Fatal("Error parsing config: trustedProxies: ", err)
+	}
+	limits, err := newRateLimiter(config.RateLimit)
+	if err != nil {
+		log.Fatal("Error parsing config: rateLimit: ", err)
+	}
+	approvals, err := newApprovalQueue(config.Approvals)
+	if err != nil {
+		log.Fatal("Error parsing config: approvals: ", err)
+	}
+	if config.UnlockTokens != nil {
+		if _, err := config.UnlockTokens.maxTTL(); err != nil {
+			log.Fatal("Error parsing config: ", err)
+		}
+	}
+	tokens, err := newTokenStore()
+	if err != nil {
+		log.Fatal("Error generating the token key: ", err)
+	}
+	n, err := sshlocker.NewNotifier(config.Hooks)
+	if err != nil {
+		log.Fatal("Error parsing config: ", err)
+	}
+	notifier.Store(n)
+	tlsConfig, err := serverTLSConfig(config)
+	if err != nil {
+		log.Fatal("Error parsing config: ", err)
+	}
+	if config.Port == "" && tlsConfig == nil {
 		config.Port = "8080"
 	} else if config.Port == "" {
 		config.Port = "8443"
 	}
 
-	http.HandleFunc("/action", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		if r.Header.Get("X-Auth-Token") != config.AccessToken {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		var req ActionRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.User == "" {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
-		}
-
-		session := Session{}
-		session.duoUsername = req.User
-		session.request = req
-
-		if req.Action != "lock" && req.Action != "unlock" {
-			http.Error(w, "Invalid action", http.StatusBadRequest)
-			return
-		}
-
-		// Step 2: Call the healthCheck to make sure Duo is accessable
-		_, err := duoClient.HealthCheck()
-
-		// Step 3: If Duo is not available to authenticate then either allow user
-		// to bypass Duo (failopen) or prevent user from authenticating (failclosed)
-		if err != nil {
-			log.Println("Duo unavailable, fail closed")
-			http.Error(w, duoUnavailable, http.StatusInternalServerError)
-			return
-		}
-
-		// Step 4: Generate and save a state variable
-		session.duoState, err = duoClient.GenerateState()
-		if err != nil {
-			log.Fatal("Error generating state: ", err)
-		}
-
-		// Step 5: Create a URL to redirect to inorder to reach the Duo prompt
-		redirectToDuoUrl, err := duoClient.CreateAuthURL(session.duoUsername, session.duoState)
-		if err != nil {
-			log.Fatal("Error creating the auth URL: ", err)
-		}
-
-		// Save the session in a map or database
-		currentSessions[session.duoState] = session
-
-		// Step 6: Redirect to that prompt
-		http.Redirect(w, r, redirectToDuoUrl, http.StatusFound)
-	})
-
-	http.HandleFunc("/duo-callback", func(w http.ResponseWriter, r *http.Request) {
-		// Step 7: Grab the state and duo_code variables from the URL parameters
-		urlState := r.URL.Query().Get("state")
-		duoCode := r.URL.Query().Get("duo_code")
-
-		// Step 8: Verify that the state in the URL matches the state saved previously
-		session, ok := currentSessions[urlState]
-		if !ok {
-			log.Println("Session not found")
-			http.Error(w, "Session not found", http.StatusBadRequest)
-			return
-		}
-
-		// remove the session from the map
-		delete(currentSessions, urlState)
-
-		if urlState != session.duoState {
-			log.Println("State mismatch")
-			http.Error(w, "State mismatch", http.StatusBadRequest)
-			return
-		}
-
-		// Step 9: Exchange the duoCode from the URL parameters and the username of the user trying to authenticate
-		// for an authentication token containing information about the auth
-		authToken, err := duoClient.ExchangeAuthorizationCodeFor2faResult(duoCode, session.duoUsername)
-		if err != nil {
-			log.Fatal("Error exchanging authToken: ", err)
-		}
-		// Step 10: Check if the authentication was successful
-		if authToken.AuthResult.Status != "allow" {
-			log.Println("Authentication failed")
-			http.Error(w, "Authentication failed", http.StatusUnauthorized)
-			return
-		}
-
-		// Step 11: If the authentication was successful, then perform the action
-		doAction(w, r, session.request)
-	})
-
-	fmt.Printf("Dispatching actions on socket %s\n", socketPath)
-	if config.TLS_Cert != "" && config.TLS_Key != "" {
-		log.Printf("Listening on port %s with TLS\n", config.Port)
-		log.Fatal(http.ListenAndServeTLS(":"+config.Port, config.TLS_Cert, config.TLS_Key, nil))
-	} else {
-		log.Printf("Listening on port %s without TLS\n", config.Port)
-		log.Fatal(http.ListenAndServe(":"+config.Port, nil))
+	srv := &server{sessions: sessions, limits: limits, approvals: approvals, requests: newRequestTracker(), tokens: tokens}
+	srv.settings.Store(&settings{config: config, auth: auth, clients: clients, hosts: hosts, proxies: proxies})
+	http.HandleFunc("/action", srv.limited(srv.handleAction))
+	http.HandleFunc("/duo-callback", srv.handleCallback)
+	http.HandleFunc("/oidc-callback", srv.handleCallback)
+	// Challenges without a redirect are answered by posting to /verify
+	http.HandleFunc("/verify", srv.limited(srv.handleVerify))
+	http.HandleFunc("/requests/{id}", srv.handleRequest)
+	http.HandleFunc("/requests/{id}/events", srv.handleRequestEvents)
+	http.HandleFunc("/approvals", srv.handleApprovals)
+	http.HandleFunc("/approvals/{id}/{decision}", srv.limited(srv.handleDecision))
+	http.HandleFunc("/tokens", srv.limited(srv.handleMintToken))
+	http.HandleFunc("/tokens/redeem", srv.limited(srv.handleRedeemToken))
+	srv.registerUI(http.DefaultServeMux)
+	srv.watchConfig(configFile)
+	go srv.sweepRequests()
+
+	if config.MetricsAddr != "" {
+		serveMetrics(config.MetricsAddr)
 	}
-}
-
-// Renders HTML page with message
-
-func doAction(w http.ResponseWriter, r *http.Request, req ActionRequest) {
 
-	conn, err := net.Dial("unix", socketPath)
-	if err != nil {
-		http.Error(w, "Dial error", http.StatusInternalServerError)
-		return
+	for _, h := range hosts {
+		fmt.Printf("Dispatching actions for host %s to %s %s\n", h.name, h.agent.Network, h.agent.Address)
 	}
-	defer conn.Close()
-
-	ip := r.RemoteAddr
-	if ip == "" {
-		ip = r.Header.Get("X-Forwarded-For")
-		if ip == "" {
-			ip = r.Header.Get("X-Real-IP")
+	log.Printf("Second factor: %s", auth.Name())
+	hs := &http.Server{Addr: ":" + config.Port, TLSConfig: tlsConfig}
+	hs.RegisterOnShutdown(srv.requests.close)
+	errs := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			log.Printf("Listening on port %s with TLS\n", config.Port)
+			errs <- hs.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Listening on port %s without TLS\n", config.Port)
+			errs <- hs.ListenAndServe()
 		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	sshlocker.SdNotify("READY=1")
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-ctx.Done():
 	}
-	if ip == "" {
-		http.Error(w, "IP not found", http.StatusBadRequest)
-		return
-	}
+	log.Printf("Received shutdown signal, shutting down...")
+	srv.shutdown(hs)
+}
 
-	_, err = fmt.Fprintf(conn, "%s\n", req.Action)
-	if err != nil {
-		http.Error(w, "Write error", http.StatusInternalServerError)
-		return
+// lockerRequest builds the ssh_locker request for req. authUser is the user
+// that passed the second factor, if any.
+func (req ActionRequest) lockerRequest(h host, ip, authUser string) sshlocker.Request {
+	r := sshlocker.Request{
+		Command:  req.Action,
+		User:     req.Account,
+		Duration: req.Duration,
+		RemoteIP: ip,
+		AuthUser: authUser,
+		Reason:   req.Reason,
+		Client:   req.Client,
+		FailOpen: req.FailOpen,
+
+		ApprovedBy: req.ApprovedBy,
+		TokenID:    req.TokenID,
 	}
-
-	resp, err := bufio.NewReader(conn).ReadString('\n')
-	if err != nil {
-		http.Error(w, "Read error", http.StatusInternalServerError)
-		return
+	if h.bound {
+		r.Host = h.name
 	}
-	fmt.Print(resp)
-
-	w.Write([]byte(`{"status":"ok","message":"` + req.Action + ` successful"}`))
-	w.WriteHeader(http.StatusOK)
-	log.Printf("Action %s for user %s from IP %s", req.Action, req.User, ip)
+	if req.Action == "recover" {
+		r.Code = req.Code
+	}
+	return r
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_web_requests_total",
+		Help: "Action requests, by action and result.",
+	}, []string{"action", "result"})
+	authResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_web_auth_results_total",
+		Help: "Second factor outcomes, by backend (e.g. duo).",
+	}, []string{"backend", "outcome"})
+	pendingSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ssh_locker_web_pending_sessions",
+		Help: "Second factor flows waiting for their answer.",
+	})
+	socketErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_web_socket_errors_total",
+		Help: "Errors talking to the ssh_locker daemons, by host.",
+	}, []string{"host"})
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_web_rate_limited_total",
+		Help: "Requests rejected by the rate limits, by scope (ip, user, lockout).",
+	}, []string{"scope"})
+	pendingApprovals = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ssh_locker_web_pending_approvals",
+		Help: "Requests waiting for approval by other users.",
+	})
+	approvalEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_web_approval_events_total",
+		Help: "Approval workflow events, e.g. approval_requested or approval_denied.",
+	}, []string{"event"})
+	lockedOutUsers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ssh_locker_web_locked_out_users",
+		Help: "Users locked out after repeated second factor denials.",
+	})
+	unlockTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_web_unlock_tokens_total",
+		Help: "Unlock token operations, by result (minted, redeemed, invalid, replayed, revoked or forbidden).",
+	}, []string{"result"})
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_locker_web_config_reloads_total",
+		Help: "Config reloads, by result (ok or rejected).",
+	}, []string{"result"})
+)
+
+// serveMetrics exposes /metrics on addr.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Printf("Serving metrics on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics listener error: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultPerIP        = 30
+	defaultPerUser      = 6
+	defaultBurst        = 5
+	defaultLockoutAfter = 3
+	defaultLockoutBase  = time.Minute
+	defaultLockoutMax   = time.Hour
+	limiterIdle         = 30 * time.Minute
+)
+
+// RateLimitConfig limits how often requests can be made and second factor
+// challenges started. Rates are per minute.
+type RateLimitConfig struct {
+	PerIP   float64 `json:"perIp,omitempty"`
+	PerUser float64 `json:"perUser,omitempty"`
+	Burst   int     `json:"burst,omitempty"`
+	// LockoutAfter denials in a row lock a user out for LockoutBase. Every
+	// further denial doubles the lockout, up to LockoutMax.
+	LockoutAfter int    `json:"lockoutAfter,omitempty"`
+	LockoutBase  string `json:"lockoutBase,omitempty"`
+	LockoutMax   string `json:"lockoutMax,omitempty"`
+}
+
+type limiterEntry struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// lockout tracks the second factor denials of a user.
+type lockout struct {
+	denials int
+	last    time.Time
+	until   time.Time
+}
+
+// rateLimits are the settings of a rateLimiter a reload may change.
+type rateLimits struct {
+	perIP        rate.Limit
+	perUser      rate.Limit
+	burst        int
+	lockoutAfter int
+	lockoutBase  time.Duration
+	lockoutMax   time.Duration
+}
+
+// rateLimiter enforces RateLimitConfig. It is safe for concurrent use.
+type rateLimiter struct {
+	mu sync.Mutex
+	rateLimits
+	ips      map[string]*limiterEntry
+	users    map[string]*limiterEntry
+	lockouts map[string]*lockout
+}
+
+func parseRateLimits(config RateLimitConfig) (rateLimits, error) {
+	l := rateLimits{
+		perIP:        perMinute(config.PerIP, defaultPerIP),
+		perUser:      perMinute(config.PerUser, defaultPerUser),
+		burst:        defaultBurst,
+		lockoutAfter: defaultLockoutAfter,
+		lockoutBase:  defaultLockoutBase,
+		lockoutMax:   defaultLockoutMax,
+	}
+	if config.Burst > 0 {
+		l.burst = config.Burst
+	}
+	if config.LockoutAfter > 0 {
+		l.lockoutAfter = config.LockoutAfter
+	}
+	var err error
+	if config.LockoutBase != "" {
+		if l.lockoutBase, err = time.ParseDuration(config.LockoutBase); err != nil {
+			return l, fmt.Errorf("invalid lockoutBase: %w", err)
+		}
+	}
+	if config.LockoutMax != "" {
+		if l.lockoutMax, err = time.ParseDuration(config.LockoutMax); err != nil {
+			return l, fmt.Errorf("invalid lockoutMax: %w", err)
+		}
+	}
+	return l, nil
+}
+
+func newRateLimiter(config RateLimitConfig) (*rateLimiter, error) {
+	l, err := parseRateLimits(config)
+	if err != nil {
+		return nil, err
+	}
+	rl := &rateLimiter{
+		rateLimits: l,
+		ips:        map[string]*limiterEntry{},
+		users:      map[string]*limiterEntry{},
+		lockouts:   map[string]*lockout{},
+	}
+	go func() {
+		for range time.Tick(sessionSweepInterval) {
+			rl.sweep()
+		}
+	}()
+	return rl, nil
+}
+
+// setLimits applies l, also to the limiters already handed out. Current
+// lockouts run their course.
+func (rl *rateLimiter) setLimits(l rateLimits) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.rateLimits = l
+	for _, e := range rl.ips {
+		e.limiter.SetLimit(l.perIP)
+		e.limiter.SetBurst(l.burst)
+	}
+	for _, e := range rl.users {
+		e.limiter.SetLimit(l.perUser)
+		e.limiter.SetBurst(l.burst)
+	}
+}
+
+func perMinute(v, def float64) rate.Limit {
+	if v <= 0 {
+		v = def
+	}
+	return rate.Limit(v / 60)
+}
+
+// allow takes a token from the limiter of key in entries, creating it with
+// the limit picked from the current limits. The limits are read under rl.mu
+// as a reload may replace them.
+func (rl *rateLimiter) allow(entries map[string]*limiterEntry, key string, limit func(rateLimits) rate.Limit) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	e, ok := entries[key]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(limit(rl.rateLimits), rl.burst)}
+		entries[key] = e
+	}
+	e.seen = time.Now()
+	return e.limiter.Allow()
+}
+
+// allowIP reports whether another request from ip may be served.
+func (rl *rateLimiter) allowIP(ip string) bool {
+	if rl.allow(rl.ips, ip, func(l rateLimits) rate.Limit { return l.perIP }) {
+		return true
+	}
+	rateLimited.WithLabelValues("ip").Inc()
+	return false
+}
+
+// allowUser reports whether another challenge may be started for user.
+func (rl *rateLimiter) allowUser(user string) bool {
+	if rl.allow(rl.users, user, func(l rateLimits) rate.Limit { return l.perUser }) {
+		return true
+	}
+	rateLimited.WithLabelValues("user").Inc()
+	return false
+}
+
+// lockedOut returns how long user remains locked out after denials.
+func (rl *rateLimiter) lockedOut(user string) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	l, ok := rl.lockouts[user]
+	if !ok {
+		return 0
+	}
+	if left := time.Until(l.until); left > 0 {
+		rateLimited.WithLabelValues("lockout").Inc()
+		return left
+	}
+	return 0
+}
+
+// denied records a denied second factor. Once lockoutAfter denials in a row
+// are reached the user is locked out, twice as long for every further one.
+func (rl *rateLimiter) denied(user string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	l, ok := rl.lockouts[user]
+	if !ok {
+		l = &lockout{}
+		rl.lockouts[user] = l
+	}
+	l.denials++
+	l.last = time.Now()
+	if l.denials < rl.lockoutAfter {
+		return
+	}
+	d := rl.lockoutBase
+	for i := rl.lockoutAfter; i < l.denials && d < rl.lockoutMax; i++ {
+		d *= 2
+	}
+	d = min(d, rl.lockoutMax)
+	l.until = time.Now().Add(d)
+	log.Printf("Locked out %s for %v after %d denials", user, d, l.denials)
+	rl.updateLockedOutLocked()
+}
+
+// succeeded clears the denials of user.
+func (rl *rateLimiter) succeeded(user string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, ok := rl.lockouts[user]; ok {
+		delete(rl.lockouts, user)
+		rl.updateLockedOutLocked()
+	}
+}
+
+func (rl *rateLimiter) updateLockedOutLocked() {
+	n := 0
+	for _, l := range rl.lockouts {
+		if time.Now().Before(l.until) {
+			n++
+		}
+	}
+	lockedOutUsers.Set(float64(n))
+}
+
+// sweep forgets idle limiters. Denials are kept for twice lockoutMax after
+// the last one, so a slow attacker still escalates.
+func (rl *rateLimiter) sweep() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, entries := range []map[string]*limiterEntry{rl.ips, rl.users} {
+		for k, e := range entries {
+			if time.Since(e.seen) > limiterIdle {
+				delete(entries, k)
+			}
+		}
+	}
+	for user, l := range rl.lockouts {
+		if time.Since(l.last) > 2*rl.lockoutMax {
+			delete(rl.lockouts, user)
+		}
+	}
+	rl.updateLockedOutLocked()
+}
+
+// limited rejects requests from clients over the per-IP rate.
+func (s *server) limited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ip := s.clientIP(r); !s.limits.allowIP(ip.String()) {
+			log.Printf("Rate limited %s %s from %s", r.Method, r.URL.Path, ip)
+			w.Header().Set("Retry-After", "60")
+			writeError(w, http.StatusTooManyRequests, codeRateLimited, "Too many requests")
+			return
+		}
+		next(w, r)
+	}
+}
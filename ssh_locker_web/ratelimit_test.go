@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRateLimiterReload(t *testing.T) {
+	rl, err := newRateLimiter(RateLimitConfig{PerIP: 60, PerUser: 60, Burst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if !rl.allowIP("192.0.2.1") {
+			t.Fatalf("request %d limited within the burst", i)
+		}
+	}
+	if rl.allowIP("192.0.2.1") {
+		t.Error("request past the burst allowed")
+	}
+
+	// New limiters pick up the limits of a reload; run with -race to check
+	// they are read under the lock
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				rl.allowIP(fmt.Sprintf("198.51.100.%d", i*50+j))
+				rl.allowUser(fmt.Sprintf("user%d-%d", i, j))
+			}
+		}(i)
+	}
+	for i := 0; i < 50; i++ {
+		l, err := parseRateLimits(RateLimitConfig{PerIP: float64(60 + i), Burst: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rl.setLimits(l)
+	}
+	wg.Wait()
+	for i := 0; i < 3; i++ {
+		if !rl.allowIP("203.0.113.1") {
+			t.Fatalf("request %d limited within the reloaded burst", i)
+		}
+	}
+}
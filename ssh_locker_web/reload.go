@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+const configPollInterval = 5 * time.Second
+
+// loadConfig reads path. A file shared with ssh_locker keeps our settings
+// under "web".
+func loadConfig(path string) (Config, error) {
+	config := Config{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("can't open config file: %w", err)
+	}
+	var shared struct {
+		Web json.RawMessage `json:"web"`
+	}
+	if json.Unmarshal(data, &shared) == nil && len(shared.Web) > 0 {
+		data = shared.Web
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&config); err != nil {
+		return config, fmt.Errorf("can't decode config JSON: %w", err)
+	}
+	return config, nil
+}
+
+// authConfig returns the parts of config the authenticator is built from.
+func authConfig(config Config) []any {
+	return []any{config.Authenticator, config.ClientId, config.ClientSecret, config.ApiHost,
+		config.RedirectUri, config.TOTP, config.WebAuthn, config.OIDC}
+}
+
+// reload validates config and swaps it in. Nothing changes if it is
+// invalid. The authenticator is only rebuilt when its settings changed, so
+// pending challenges survive unrelated edits. Requests in flight finish
+// with the settings they started with.
+func (s *server) reload(config Config) error {
+	cur := s.current()
+	prev, auth := cur.config, cur.auth
+
+	// The listeners and the session file are only read at startup, so the
+	// rest is validated against the running ones. The certificate itself is
+	// reloaded when its files change.
+	restart := config.Port != prev.Port && config.Port != "" ||
+		config.TLS_Cert != prev.TLS_Cert || config.TLS_Key != prev.TLS_Key || !reflect.DeepEqual(config.TLS, prev.TLS) ||
+		config.MetricsAddr != prev.MetricsAddr || config.Sessions.File != prev.Sessions.File
+	config.Port, config.TLS_Cert, config.TLS_Key, config.TLS = prev.Port, prev.TLS_Cert, prev.TLS_Key, prev.TLS
+	config.MetricsAddr, config.Sessions.File = prev.MetricsAddr, prev.Sessions.File
+
+	var err error
+	if !reflect.DeepEqual(authConfig(prev), authConfig(config)) {
+		if auth, err = newAuthenticator(config); err != nil {
+			return err
+		}
+		if t, ok := auth.(*totpAuthenticator); ok {
+			if prevTOTP, ok := cur.auth.(*totpAuthenticator); ok {
+				t.inherit(prevTOTP)
+			}
+		}
+	}
+	if err := config.FailPolicy.validate(); err != nil {
+		return err
+	}
+	clients, err := loadClients(config)
+	if err != nil {
+		return err
+	}
+	if len(clients) == 0 {
+		return fmt.Errorf("no accessToken or apiClients")
+	}
+	hosts, err := loadHosts(config)
+	if err != nil {
+		return err
+	}
+	proxies, err := parsePrefixes(config.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("trustedProxies: %w", err)
+	}
+	limits, err := parseRateLimits(config.RateLimit)
+	if err != nil {
+		return fmt.Errorf("rateLimit: %w", err)
+	}
+	sessions, err := parseSessionLimits(config.Sessions)
+	if err != nil {
+		return err
+	}
+	approvals, err := parseApprovalSettings(config.Approvals)
+	if err != nil {
+		return fmt.Errorf("approvals: %w", err)
+	}
+	if config.UnlockTokens != nil {
+		if _, err := config.UnlockTokens.maxTTL(); err != nil {
+			return err
+		}
+	}
+	n, err := sshlocker.NewNotifier(config.Hooks)
+	if err != nil {
+		return err
+	}
+
+	if restart {
+		log.Printf("port, tlsCert, tlsKey, tls, metricsAddr or sessions.file changed, restart to apply them")
+	}
+
+	s.settings.Store(&settings{config: config, auth: auth, clients: clients, hosts: hosts, proxies: proxies})
+	s.limits.setLimits(limits)
+	s.sessions.setLimits(sessions)
+	s.approvals.setSettings(approvals)
+	if old := notifier.Swap(n); old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// reloadConfig rereads path. An invalid file is rejected and the running
+// config kept.
+func (s *server) reloadConfig(path string) {
+	config, err := loadConfig(path)
+	if err == nil {
+		err = s.reload(config)
+	}
+	if err != nil {
+		log.Printf("Reload rejected, keeping the current config: %v", err)
+		configReloads.WithLabelValues("rejected").Inc()
+		return
+	}
+	configReloads.WithLabelValues("ok").Inc()
+	log.Printf("Config reloaded, second factor: %s", s.current().auth.Name())
+}
+
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+func statConfig(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}
+}
+
+// watchConfig reloads path on SIGHUP, or when its modification time or size
+// changes.
+func (s *server) watchConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	last := statConfig(path)
+	go func() {
+		ticker := time.NewTicker(configPollInterval)
+		for {
+			select {
+			case <-hup:
+				log.Printf("Received SIGHUP, reloading %s", path)
+			case <-ticker.C:
+				if statConfig(path) == last {
+					continue
+				}
+				log.Printf("%s changed, reloading", path)
+			}
+			last = statConfig(path)
+			s.reloadConfig(path)
+		}
+	}()
+}
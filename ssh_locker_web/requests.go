@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// resultTTL is how long a finished request can be polled.
+	resultTTL = 10 * time.Minute
+	// sseKeepalive is how often an idle event stream is kept alive.
+	sseKeepalive = 15 * time.Second
+)
+
+// Statuses of a request, as reported by GET /requests/{id}.
+const (
+	// statusPending waits for the second factor or for approvers.
+	statusPending = "pending"
+	// statusApproved passed and is being sent to ssh_locker.
+	statusApproved = "approved"
+	statusDenied   = "denied"
+	statusExecuted = "executed"
+	statusFailed   = "failed"
+)
+
+// requestState is what GET /requests/{id} and its event stream report.
+type requestState struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Action  string `json:"action"`
+	User    string `json:"user"`
+	Account string `json:"account,omitempty"`
+	Host    string `json:"host,omitempty"`
+	// Approval is the approval request the request waits for, if any.
+	Approval string    `json:"approval,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Code     string    `json:"code,omitempty"`
+	Updated  time.Time `json:"updated"`
+}
+
+func (st requestState) finished() bool {
+	return st.Status == statusDenied || st.Status == statusExecuted || st.Status == statusFailed
+}
+
+type trackedRequest struct {
+	state    requestState
+	client   string
+	watchers map[chan requestState]bool
+}
+
+// requestTracker follows API requests from the second factor to ssh_locker,
+// so clients can poll or watch them. It is safe for concurrent use.
+type requestTracker struct {
+	mu       sync.Mutex
+	requests map[string]*trackedRequest
+	// approvals maps approval requests to the request that queued them.
+	approvals map[string]string
+	// closing is closed on shutdown to end the event streams.
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{
+		requests:  map[string]*trackedRequest{},
+		approvals: map[string]string{},
+		closing:   make(chan struct{}),
+	}
+}
+
+// start tracks req, made by client, as pending under id.
+func (rt *requestTracker) start(id, client string, req ActionRequest) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.requests[id] = &trackedRequest{
+		state: requestState{
+			ID:      id,
+			Status:  statusPending,
+			Action:  req.Action,
+			User:    req.User,
+			Account: req.Account,
+			Host:    req.Host,
+			Updated: time.Now(),
+		},
+		client:   client,
+		watchers: map[chan requestState]bool{},
+	}
+}
+
+// set changes the status of id and tells its watchers. Unknown ids, e.g.
+// of flows from the web UI, are ignored.
+func (rt *requestTracker) set(id, status, message, code string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if tr, ok := rt.requests[id]; ok {
+		rt.setLocked(tr, status, message, code)
+	}
+}
+
+func (rt *requestTracker) setLocked(tr *trackedRequest, status, message, code string) {
+	tr.state.Status, tr.state.Message, tr.state.Code = status, message, code
+	tr.state.Updated = time.Now()
+	for ch := range tr.watchers {
+		// Watchers only care about the latest state
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- tr.state
+	}
+}
+
+// finish records the outcome of executing id.
+func (rt *requestTracker) finish(id string, result actionResult, err error) {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+		rt.set(id, statusFailed, apiErr.message, apiErr.code)
+	case err != nil:
+		rt.set(id, statusFailed, "Internal error", codeInternal)
+	case result.approval != "":
+		rt.mu.Lock()
+		if tr, ok := rt.requests[id]; ok {
+			tr.state.Approval = result.approval
+			rt.approvals[result.approval] = id
+		}
+		rt.mu.Unlock()
+		rt.set(id, statusPending, result.message, "")
+	default:
+		rt.set(id, statusExecuted, result.message, "")
+	}
+}
+
+// forApproval returns the request that queued approval, or "".
+func (rt *requestTracker) forApproval(approval string) string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.approvals[approval]
+}
+
+// get returns the state of id and the client that made it. Requests can
+// also be looked up by the approval request they wait for.
+func (rt *requestTracker) get(id string) (requestState, string, bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	tr, ok := rt.lookupLocked(id)
+	if !ok {
+		return requestState{}, "", false
+	}
+	return tr.state, tr.client, true
+}
+
+func (rt *requestTracker) lookupLocked(id string) (*trackedRequest, bool) {
+	if tr, ok := rt.requests[id]; ok {
+		return tr, true
+	}
+	tr, ok := rt.requests[rt.approvals[id]]
+	return tr, ok
+}
+
+// watch returns a channel that receives the state of id when it changes,
+// and a function to stop watching.
+func (rt *requestTracker) watch(id string) (<-chan requestState, func()) {
+	ch := make(chan requestState, 1)
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	tr, ok := rt.lookupLocked(id)
+	if !ok {
+		return ch, func() {}
+	}
+	tr.watchers[ch] = true
+	return ch, func() {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		delete(tr.watchers, ch)
+	}
+}
+
+// close ends the event streams.
+func (rt *requestTracker) close() {
+	rt.closeOnce.Do(func() { close(rt.closing) })
+}
+
+// sweep forgets finished requests after resultTTL. A pending request whose
+// session or approval request is gone can't finish anymore; it fails once
+// it has gone a sweep interval without news.
+func (rt *requestTracker) sweep(alive func(requestState) bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for id, tr := range rt.requests {
+		switch {
+		case tr.state.finished() && time.Since(tr.state.Updated) >= resultTTL:
+			delete(rt.requests, id)
+			if tr.state.Approval != "" {
+				delete(rt.approvals, tr.state.Approval)
+			}
+		case tr.state.Status == statusPending && time.Since(tr.state.Updated) >= sessionSweepInterval && !alive(tr.state):
+			rt.setLocked(tr, statusFailed, "Request expired", codeRequestExpired)
+		}
+	}
+}
+
+// sweepRequests periodically sweeps the tracked requests.
+func (s *server) sweepRequests() {
+	for range time.Tick(sessionSweepInterval) {
+		s.requests.sweep(func(st requestState) bool {
+			if st.Approval != "" {
+				_, ok := s.approvals.get(st.Approval)
+				return ok
+			}
+			_, ok := s.sessions.Get(st.ID)
+			return ok
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// server holds the state shared by the API and UI handlers.
+type server struct {
+	// settings is swapped whole by reloads; a request works on the
+	// snapshot it loaded.
+	settings  atomic.Pointer[settings]
+	sessions  *sessionStore
+	ui        *uiSessionStore
+	limits    *rateLimiter
+	approvals *approvalQueue
+	// requests tracks API requests for GET /requests/{id}.
+	requests *requestTracker
+	// tokens signs unlock tokens and tracks the redeemed ones.
+	tokens *tokenStore
+}
+
+// settings are the parts of the server built from the config.
+type settings struct {
+	config  Config
+	auth    Authenticator
+	clients []*APIClient
+	hosts   []host
+	// proxies are the trusted reverse proxies whose forwarding headers are
+	// believed.
+	proxies []netip.Prefix
+}
+
+// current returns the settings in effect.
+func (s *server) current() *settings {
+	return s.settings.Load()
+}
+
+// apiError is a request failure with its HTTP status and error code.
+type apiError struct {
+	status  int
+	code    string
+	message string
+	// retryAfter is sent as Retry-After when set.
+	retryAfter time.Duration
+}
+
+func (e *apiError) Error() string { return e.message }
+
+func newAPIError(status int, code, message string) *apiError {
+	return &apiError{status: status, code: code, message: message}
+}
+
+// actionResult is the outcome of an action request: either the action ran
+// and message holds the ssh_locker reply, or a challenge or approval is
+// pending.
+type actionResult struct {
+	message   string
+	state     string
+	challenge *Challenge
+	// approval is the ID of the request while it waits for approvals.
+	approval string
+}
+
+// startAction validates req and starts its second factor. Read-only actions,
+// answered TOTP codes and fail-open requests run right away.
+func (s *server) startAction(r *http.Request, client *APIClient, req ActionRequest, ui bool) (actionResult, error) {
+	st := s.current()
+	if req.User == "" {
+		requestsTotal.WithLabelValues("unknown", "invalid").Inc()
+		return actionResult{}, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid request")
+	}
+	req.Client = client.Name
+	if req.Action == "approve" || req.Action == "deny" {
+		// Decisions are bound to the host and account of the request they
+		// decide
+		p, ok := s.approvals.get(req.Approval)
+		if !ok {
+			requestsTotal.WithLabelValues(req.Action, "invalid").Inc()
+			return actionResult{}, newAPIError(http.StatusNotFound, codeApprovalNotFound, "Approval request not found")
+		}
+		req.Host, req.Account = p.Request.Host, p.Request.Account
+	}
+	ip := s.clientIP(r)
+	if !client.allowsIP(ip) {
+		log.Printf("API client %s may not connect from %s", client.Name, ip)
+		requestsTotal.WithLabelValues("unknown", "forbidden").Inc()
+		return actionResult{}, newAPIError(http.StatusForbidden, codeForbidden, "Forbidden")
+	}
+	h, ok := s.host(req.Host)
+	if !ok {
+		requestsTotal.WithLabelValues("unknown", "invalid").Inc()
+		return actionResult{}, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Unknown host")
+	}
+	// The approval is bound to the resolved host, which is kept in the session
+	req.Host = h.name
+	if !client.allows(req) {
+		log.Printf("API client %s may not %s %s for %s on %s from %s", client.Name, req.Action, req.Account, req.User, req.Host, ip)
+		requestsTotal.WithLabelValues("unknown", "forbidden").Inc()
+		return actionResult{}, newAPIError(http.StatusForbidden, codeForbidden, "Forbidden")
+	}
+
+	session := Session{}
+	session.username = req.User
+	session.request = req
+	session.data = map[string]string{}
+	session.ui = ui
+
+	switch req.Action {
+	case "lock", "unlock", "extend", "approve", "deny":
+	case "status", "list":
+		// Read-only actions don't change the lock state, so they skip the second factor
+		return s.dispatch(ip, req, "")
+	case "recover":
+		// Recovery codes are the break-glass path for when the second factor
+		// is down; ssh_locker checks the code and audits its use
+		if req.Code == "" {
+			requestsTotal.WithLabelValues(req.Action, "invalid").Inc()
+			return actionResult{}, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Missing code")
+		}
+		return s.dispatch(ip, req, "")
+	default:
+		requestsTotal.WithLabelValues("unknown", "invalid").Inc()
+		return actionResult{}, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid action")
+	}
+	if req.Action == "extend" && req.Duration == "" {
+		requestsTotal.WithLabelValues(req.Action, "invalid").Inc()
+		return actionResult{}, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Missing duration")
+	}
+	if policy := s.approvals.policyFor(req); policy != nil {
+		if problem := policy.reasonProblem(req); problem != "" {
+			requestsTotal.WithLabelValues(req.Action, "invalid").Inc()
+			return actionResult{}, newAPIError(http.StatusBadRequest, codeInvalidRequest, problem)
+		}
+	}
+
+	// Limit how often a user can be challenged, e.g. sent a Duo push
+	if left := s.limits.lockedOut(req.User); left > 0 {
+		log.Printf("Rejected %s for %s from %s: locked out for %v", req.Action, req.User, ip, left.Round(time.Second))
+		requestsTotal.WithLabelValues(req.Action, "locked_out").Inc()
+		apiErr := newAPIError(http.StatusTooManyRequests, codeLockedOut, "Too many denied attempts")
+		apiErr.retryAfter = left
+		return actionResult{}, apiErr
+	}
+	if !s.limits.allowUser(req.User) {
+		log.Printf("Rate limited %s for %s from %s", req.Action, req.User, ip)
+		requestsTotal.WithLabelValues(req.Action, "rate_limited").Inc()
+		apiErr := newAPIError(http.StatusTooManyRequests, codeRateLimited, "Too many requests")
+		apiErr.retryAfter = time.Minute
+		return actionResult{}, apiErr
+	}
+
+	// Step 2: Call the healthCheck to make sure the backend is accessable
+	err := st.auth.HealthCheck()
+
+	// Step 3: If the backend is not available to authenticate then either allow user
+	// to bypass it (failopen) or prevent user from authenticating (failclosed).
+	// Approvals always fail closed: without the second factor the approver
+	// is only a name the client sent.
+	if err != nil {
+		authResults.WithLabelValues(st.auth.Name(), "unavailable").Inc()
+		decision := req.Action == "approve" || req.Action == "deny"
+		if !decision && st.config.FailPolicy.policyFor(req.User) == failOpen {
+			log.Printf("%s unavailable, fail open for %s: %v", st.auth.Name(), req.User, err)
+			requestsTotal.WithLabelValues(req.Action, "auth_fail_open").Inc()
+			req.FailOpen = true
+			return s.execute(ip, req, "")
+		}
+		log.Printf("%s unavailable, fail closed: %v", st.auth.Name(), err)
+		requestsTotal.WithLabelValues(req.Action, "auth_unavailable").Inc()
+		return actionResult{}, newAPIError(http.StatusServiceUnavailable, codeAuthUnavailable, authUnavailable)
+	}
+
+	// Step 4: Generate and save a state variable
+	session.state, err = randomString(32)
+	if err != nil {
+		log.Printf("Error generating state: %v", err)
+		return actionResult{}, newAPIError(http.StatusInternalServerError, codeInternal, "Internal error")
+	}
+
+	// Step 5: Start the challenge, e.g. create the URL of the Duo prompt
+	challenge, err := st.auth.Begin(&session)
+	if err != nil {
+		log.Printf("Error starting %s challenge: %v", st.auth.Name(), err)
+		return actionResult{}, newAPIError(http.StatusBadGateway, codeAuthError, "Can't start authentication")
+	}
+
+	// API requests can be polled by their state
+	if !ui {
+		s.requests.start(session.state, req.Client, req)
+	}
+
+	// Challenges that are answered inline (TOTP) don't need a session
+	if challenge.RedirectURL == "" && req.Code != "" {
+		return s.completeAction(r, session, AuthResponse{State: session.state, Code: req.Code})
+	}
+
+	// Save the session in the session store
+	if err := s.sessions.Add(session); err != nil {
+		log.Printf("Rejected %s for %s: %v", req.Action, req.User, err)
+		requestsTotal.WithLabelValues(req.Action, "too_many_pending").Inc()
+		s.requests.set(session.state, statusFailed, "Too many pending requests", codeTooManyPending)
+		return actionResult{}, newAPIError(http.StatusTooManyRequests, codeTooManyPending, "Too many pending requests")
+	}
+	requestsTotal.WithLabelValues(req.Action, "auth_pending").Inc()
+
+	// Step 6: Hand the challenge to the caller, who redirects to the prompt
+	return actionResult{state: session.state, challenge: &challenge}, nil
+}
+
+// resumeAction looks up the pending session of resp and completes it. The
+// session is returned even on failure so the caller can pick the response
+// format.
+func (s *server) resumeAction(r *http.Request, resp AuthResponse) (Session, actionResult, error) {
+	// Step 8: Verify that the state matches the state saved previously
+	// Taking the session removes it from the store, so each state is used once
+	session, ok := s.sessions.Take(resp.State)
+	if !ok {
+		log.Println("Session not found")
+		return session, actionResult{}, newAPIError(http.StatusBadRequest, codeSessionNotFound, "Session not found")
+	}
+
+	if resp.State != session.state {
+		log.Println("State mismatch")
+		return session, actionResult{}, newAPIError(http.StatusBadRequest, codeSessionNotFound, "State mismatch")
+	}
+	result, err := s.completeAction(r, session, resp)
+	return session, result, err
+}
+
+// completeAction verifies the answer to the session's challenge and performs
+// the action if it is correct.
+func (s *server) completeAction(r *http.Request, session Session, resp AuthResponse) (actionResult, error) {
+	// Step 9: Check the answer, e.g. exchange the duo_code for the auth result
+	auth := s.current().auth
+	err := auth.Verify(&session, resp)
+	// Step 10: Check if the authentication was successful
+	if err != nil {
+		outcome := "error"
+		switch {
+		case errors.Is(err, errAuthDenied):
+			outcome = "deny"
+		case errors.Is(err, errAuthInvalid):
+			outcome = "invalid"
+		case errors.Is(err, errAuthUnavailable):
+			outcome = "unavailable"
+		}
+		log.Printf("Authentication of %s from %s failed (%s): %v", session.username, s.clientIP(r), outcome, err)
+		if outcome == "deny" {
+			s.limits.denied(session.username)
+		}
+		authResults.WithLabelValues(auth.Name(), outcome).Inc()
+		requestsTotal.WithLabelValues(session.request.Action, "auth_"+outcome).Inc()
+		apiErr := authError(err)
+		status := statusFailed
+		if outcome == "deny" {
+			status = statusDenied
+		}
+		s.requests.set(session.state, status, apiErr.message, apiErr.code)
+		return actionResult{}, apiErr
+	}
+
+	authResults.WithLabelValues(auth.Name(), "allow").Inc()
+	s.limits.succeeded(session.username)
+	s.requests.set(session.state, statusApproved, "", "")
+
+	// Step 11: If the authentication was successful, then perform the action
+	result, err := s.execute(s.clientIP(r), session.request, session.username)
+	s.requests.finish(session.state, result, err)
+	return result, err
+}
+
+// execute performs an action whose second factor passed, unless an approval
+// policy makes it wait for other users.
+func (s *server) execute(ip netip.Addr, req ActionRequest, authUser string) (actionResult, error) {
+	switch req.Action {
+	case "approve", "deny":
+		return s.decideApproval(req)
+	}
+	if policy := s.approvals.policyFor(req); policy != nil && policy.Required > 0 {
+		return s.requestApproval(ip, req, authUser, policy)
+	}
+	return s.dispatch(ip, req, authUser)
+}
+
+// dispatch sends the action to ssh_locker. authUser is the user that passed
+// the second factor, if any.
+func (s *server) dispatch(ip netip.Addr, req ActionRequest, authUser string) (actionResult, error) {
+	if !ip.IsValid() {
+		return actionResult{}, newAPIError(http.StatusBadRequest, codeInvalidRequest, "IP not found")
+	}
+
+	h, ok := s.host(req.Host)
+	if !ok {
+		return actionResult{}, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Unknown host")
+	}
+	resp, err := h.agent.SendRequest(req.lockerRequest(h, ip.String(), authUser))
+	if err != nil {
+		log.Printf("Action %s for user %s on %s failed: %v", req.Action, req.User, h.name, err)
+		socketErrors.WithLabelValues(h.name).Inc()
+		requestsTotal.WithLabelValues(req.Action, "socket_error").Inc()
+		return actionResult{}, newAPIError(http.StatusBadGateway, codeSocketError, "Socket error")
+	}
+
+	log.Printf("Action %s for user %s on %s from IP %s via %s: %s", req.Action, req.User, h.name, ip, req.Client, resp)
+	if failed, status := lockerFailure(resp); failed {
+		requestsTotal.WithLabelValues(req.Action, "failed").Inc()
+		return actionResult{}, newAPIError(status, codeActionFailed, resp)
+	}
+	requestsTotal.WithLabelValues(req.Action, "ok").Inc()
+	return actionResult{message: resp}, nil
+}
+
+// lockerFailure reports whether an ssh_locker reply is an error, and the
+// HTTP status to return for it.
+func lockerFailure(resp string) (bool, int) {
+	switch {
+	case resp == "Permission denied":
+		return true, http.StatusForbidden
+	case resp == "Unknown command", strings.Contains(resp, " failed: "):
+		return true, http.StatusUnprocessableEntity
+	}
+	return false, http.StatusOK
+}
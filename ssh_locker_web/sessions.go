@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSessionTTL        = 10 * time.Minute
+	defaultMaxPendingPerUser = 3
+	defaultMaxPending        = 100
+	sessionSweepInterval     = time.Minute
+)
+
+var errTooManyPending = errors.New("too many pending requests")
+
+// SessionConfig configures the store of pending second factor flows.
+type SessionConfig struct {
+	TTL               string `json:"ttl,omitempty"`
+	MaxPendingPerUser int    `json:"maxPendingPerUser,omitempty"`
+	// MaxPending caps the pending sessions of all users together.
+	MaxPending int `json:"maxPending,omitempty"`
+	// File persists pending sessions so a restart doesn't strand users.
+	File string `json:"file,omitempty"`
+}
+
+// Session is a pending second factor flow, keyed by its state.
+type Session struct {
+	state    string
+	username string
+	request  ActionRequest
+	// data holds authenticator specific state, e.g. an OIDC nonce.
+	data    map[string]string
+	created time.Time
+	// ui is set for flows started from the web UI, which aren't tracked
+	// for /requests/{id}.
+	ui bool
+}
+
+// storedSession is the on-disk form of a Session.
+type storedSession struct {
+	State    string            `json:"state"`
+	Username string            `json:"username"`
+	Request  ActionRequest     `json:"request"`
+	Client   string            `json:"client"`
+	Data     map[string]string `json:"data,omitempty"`
+	Created  time.Time         `json:"created"`
+	UI       bool              `json:"ui,omitempty"`
+}
+
+// sessionLimits are the settings of a sessionStore a reload may change.
+type sessionLimits struct {
+	ttl        time.Duration
+	maxPerUser int
+	maxPending int
+}
+
+// sessionStore holds pending sessions keyed by state. It is safe for
+// concurrent use; sessions expire after ttl.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+	sessionLimits
+	file string
+}
+
+func parseSessionLimits(config SessionConfig) (sessionLimits, error) {
+	l := sessionLimits{
+		ttl:        defaultSessionTTL,
+		maxPerUser: defaultMaxPendingPerUser,
+		maxPending: defaultMaxPending,
+	}
+	if config.TTL != "" {
+		d, err := time.ParseDuration(config.TTL)
+		if err != nil {
+			return l, fmt.Errorf("invalid session ttl: %w", err)
+		}
+		l.ttl = d
+	}
+	if config.MaxPendingPerUser != 0 {
+		l.maxPerUser = config.MaxPendingPerUser
+	}
+	if config.MaxPending != 0 {
+		l.maxPending = config.MaxPending
+	}
+	return l, nil
+}
+
+func newSessionStore(config SessionConfig) (*sessionStore, error) {
+	l, err := parseSessionLimits(config)
+	if err != nil {
+		return nil, err
+	}
+	st := &sessionStore{sessions: map[string]Session{}, sessionLimits: l, file: config.File}
+	if err := st.load(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(sessionSweepInterval) {
+			st.sweep()
+		}
+	}()
+	return st, nil
+}
+
+// setLimits applies l to the store. Pending sessions are kept.
+func (st *sessionStore) setLimits(l sessionLimits) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sessionLimits = l
+}
+
+// Add stores s unless its user already has maxPerUser pending sessions or
+// maxPending sessions are pending overall.
+func (st *sessionStore) Add(s Session) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sweepLocked()
+	if len(st.sessions) >= st.maxPending {
+		return errTooManyPending
+	}
+	pending := 0
+	for _, other := range st.sessions {
+		if other.username == s.username {
+			pending++
+		}
+	}
+	if pending >= st.maxPerUser {
+		return errTooManyPending
+	}
+	s.created = time.Now()
+	st.sessions[s.state] = s
+	st.changedLocked()
+	return nil
+}
+
+// Get returns the session for state without removing it, if it hasn't
+// expired.
+func (st *sessionStore) Get(state string) (Session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.sessions[state]
+	return s, ok && time.Since(s.created) < st.ttl
+}
+
+// Take removes and returns the session for state, if it hasn't expired.
+func (st *sessionStore) Take(state string) (Session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.sessions[state]
+	if !ok {
+		return s, false
+	}
+	delete(st.sessions, state)
+	st.changedLocked()
+	return s, time.Since(s.created) < st.ttl
+}
+
+func (st *sessionStore) sweep() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sweepLocked()
+}
+
+// sweepLocked drops abandoned sessions. The caller must hold st.mu.
+func (st *sessionStore) sweepLocked() {
+	expired := 0
+	for state, s := range st.sessions {
+		if time.Since(s.created) >= st.ttl {
+			delete(st.sessions, state)
+			expired++
+		}
+	}
+	if expired > 0 {
+		log.Printf("Expired %d abandoned sessions", expired)
+		st.changedLocked()
+	}
+}
+
+// changedLocked updates the metrics and the session file after a change.
+// The caller must hold st.mu.
+func (st *sessionStore) changedLocked() {
+	pendingSessions.Set(float64(len(st.sessions)))
+	if st.file == "" {
+		return
+	}
+	stored := make([]storedSession, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		stored = append(stored, storedSession{
+			State:    s.state,
+			Username: s.username,
+			Request:  s.request,
+			Client:   s.request.Client,
+			Data:     s.data,
+			Created:  s.created,
+			UI:       s.ui,
+		})
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		log.Printf("Can't encode sessions: %v", err)
+		return
+	}
+	tmp := st.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Can't write session file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, st.file); err != nil {
+		log.Printf("Can't replace session file: %v", err)
+	}
+}
+
+func (st *sessionStore) load() error {
+	if st.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(st.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read session file: %w", err)
+	}
+	var stored []storedSession
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("can't decode session file: %w", err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, ss := range stored {
+		ss.Request.Client = ss.Client
+		if ss.Data == nil {
+			ss.Data = map[string]string{}
+		}
+		st.sessions[ss.State] = Session{
+			state:    ss.State,
+			username: ss.Username,
+			request:  ss.Request,
+			data:     ss.Data,
+			created:  ss.Created,
+			ui:       ss.UI,
+		}
+	}
+	st.sweepLocked()
+	pendingSessions.Set(float64(len(st.sessions)))
+	log.Printf("Restored %d pending sessions", len(st.sessions))
+	return nil
+}
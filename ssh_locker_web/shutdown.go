@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+)
+
+var shutdownTimeout = 10 * time.Second
+
+// shutdown stops accepting requests and waits up to shutdownTimeout for the
+// ones in flight, then flushes the hooks. Pending sessions are already on
+// disk when sessions.file is set.
+func (s *server) shutdown(hs *http.Server) {
+	sshlocker.SdNotify("STOPPING=1")
+	log.Printf("Shutting down, draining requests in flight")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		log.Printf("Requests still running after %v, shutting down anyway", shutdownTimeout)
+		hs.Close()
+	}
+	notifier.Load().Close()
+	log.Printf("Shutdown complete")
+}
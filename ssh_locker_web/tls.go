@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig tunes HTTPS. The certificate is read from tlsCert and tlsKey,
+// and reloaded when they change, or obtained with ACME.
+type TLSConfig struct {
+	// MinVersion is "1.2" (default) or "1.3".
+	MinVersion string `json:"minVersion,omitempty"`
+	// CipherSuites restricts the TLS 1.2 cipher suites, by their Go names,
+	// e.g. TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384. TLS 1.3 suites can't be
+	// configured.
+	CipherSuites []string `json:"cipherSuites,omitempty"`
+	// ClientCA verifies the certificates of API clients with a commonName.
+	ClientCA string      `json:"clientCA,omitempty"`
+	ACME     *ACMEConfig `json:"acme,omitempty"`
+}
+
+// ACMEConfig obtains and renews the certificate from an ACME CA.
+type ACMEConfig struct {
+	Domains []string `json:"domains"`
+	Email   string   `json:"email,omitempty"`
+	// CacheDir keeps the account key and certificates across restarts.
+	CacheDir string `json:"cacheDir"`
+	// DirectoryURL defaults to Let's Encrypt. Point it at e.g.
+	// https://localhost:14000/dir to test against pebble.
+	DirectoryURL string `json:"directoryUrl,omitempty"`
+	// DirectoryCA is a PEM bundle to trust for the directory, e.g. pebble's
+	// root.
+	DirectoryCA string `json:"directoryCA,omitempty"`
+	// HTTPAddr serves http-01 challenges, e.g. ":80". tls-alpn-01
+	// challenges are answered on the HTTPS port.
+	HTTPAddr string `json:"httpAddr,omitempty"`
+}
+
+// tlsEnabled reports whether config serves HTTPS.
+func tlsEnabled(config Config) bool {
+	return config.TLS_Cert != "" || config.TLS_Key != "" || config.TLS.ACME != nil
+}
+
+// serverTLSConfig builds the HTTPS config, or returns nil for plain HTTP.
+func serverTLSConfig(config Config) (*tls.Config, error) {
+	if !tlsEnabled(config) {
+		return nil, nil
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch config.TLS.MinVersion {
+	case "", "1.2":
+	case "1.3":
+		tc.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("tls: unsupported minVersion %q", config.TLS.MinVersion)
+	}
+	for _, name := range config.TLS.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("tls: unknown or insecure cipher suite %s", name)
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+
+	if a := config.TLS.ACME; a != nil {
+		if config.TLS_Cert != "" || config.TLS_Key != "" {
+			return nil, fmt.Errorf("tls: acme and tlsCert/tlsKey are exclusive")
+		}
+		m, err := acmeManager(*a)
+		if err != nil {
+			return nil, err
+		}
+		tc.GetCertificate = m.GetCertificate
+		tc.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		if a.HTTPAddr != "" {
+			log.Printf("Serving ACME http-01 challenges on %s", a.HTTPAddr)
+			go func() {
+				if err := http.ListenAndServe(a.HTTPAddr, m.HTTPHandler(nil)); err != nil {
+					log.Printf("ACME listener error: %v", err)
+				}
+			}()
+		}
+	} else {
+		if config.TLS_Cert == "" || config.TLS_Key == "" {
+			return nil, fmt.Errorf("tlsCert and tlsKey are both required")
+		}
+		c, err := newCertReloader(config.TLS_Cert, config.TLS_Key)
+		if err != nil {
+			return nil, err
+		}
+		tc.GetCertificate = c.getCertificate
+	}
+
+	if config.TLS.ClientCA != "" {
+		pool, err := sshlocker.LoadCertPool(config.TLS.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("tls: clientCA: %w", err)
+		}
+		// Browsers have no certificate, so one is only verified if given
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
+}
+
+func cipherSuite(name string) (uint16, bool) {
+	for _, s := range tls.CipherSuites() {
+		if s.Name == name {
+			return s.ID, true
+		}
+	}
+	return 0, false
+}
+
+func acmeManager(config ACMEConfig) (*autocert.Manager, error) {
+	if len(config.Domains) == 0 || config.CacheDir == "" {
+		return nil, fmt.Errorf("tls: acme domains and cacheDir are required")
+	}
+	client := &acme.Client{DirectoryURL: config.DirectoryURL}
+	if config.DirectoryCA != "" {
+		pool, err := sshlocker.LoadCertPool(config.DirectoryCA)
+		if err != nil {
+			return nil, fmt.Errorf("tls: acme directoryCA: %w", err)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.CacheDir),
+		HostPolicy: autocert.HostWhitelist(config.Domains...),
+		Email:      config.Email,
+		Client:     client,
+	}, nil
+}
+
+// certReloader serves a certificate from disk and reloads it when the files
+// change, so renewals need no restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	stamp [2]fileStamp
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(configPollInterval) {
+			if c.changed() {
+				if err := c.load(); err != nil {
+					log.Printf("Can't reload certificate, keeping the current one: %v", err)
+					continue
+				}
+				log.Printf("Reloaded certificate %s", c.certFile)
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (c *certReloader) stamps() [2]fileStamp {
+	return [2]fileStamp{statConfig(c.certFile), statConfig(c.keyFile)}
+}
+
+func (c *certReloader) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stamps() != c.stamp
+}
+
+func (c *certReloader) load() error {
+	stamp := c.stamps()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A failed load isn't retried until the files change again
+	c.stamp = stamp
+	if err != nil {
+		return fmt.Errorf("can't load certificate: %w", err)
+	}
+	c.cert = &cert
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/a13labs/systools/internal/sshlocker"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+const (
+	defaultTokenTTL = 5 * time.Minute
+	tokenIssuer     = "ssh_locker_web"
+)
+
+var (
+	errTokenInvalid  = errors.New("invalid token")
+	errTokenRedeemed = errors.New("token already redeemed")
+)
+
+// UnlockTokenConfig enables signed, single-use unlock tokens for machine
+// clients that can't pass a second factor, e.g. CI jobs. Tokens are signed
+// with a key generated at startup, so a restart invalidates them; that keeps
+// the record of redeemed tokens, which lives in memory, sound.
+type UnlockTokenConfig struct {
+	// MaxTTL caps how long a token can be redeemed, 5m by default.
+	MaxTTL string `json:"maxTtl,omitempty"`
+}
+
+func (c *UnlockTokenConfig) maxTTL() (time.Duration, error) {
+	if c.MaxTTL == "" {
+		return defaultTokenTTL, nil
+	}
+	d, err := time.ParseDuration(c.MaxTTL)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("unlockTokens: invalid maxTtl %q", c.MaxTTL)
+	}
+	return d, nil
+}
+
+// tokenRequest is the body of POST /tokens. User is recorded as the user
+// that authorized the unlock; TTL defaults to, and may not exceed, maxTtl.
+type tokenRequest struct {
+	User     string `json:"user"`
+	Account  string `json:"account"`
+	Host     string `json:"host,omitempty"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason,omitempty"`
+	TTL      string `json:"ttl,omitempty"`
+}
+
+// tokenStore signs unlock tokens and remembers the redeemed ones until they
+// expire. It is safe for concurrent use.
+type tokenStore struct {
+	key []byte
+
+	mu       sync.Mutex
+	redeemed map[string]time.Time
+}
+
+func newTokenStore() (*tokenStore, error) {
+	ts := &tokenStore{key: make([]byte, 32), redeemed: map[string]time.Time{}}
+	if _, err := rand.Read(ts.key); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(sessionSweepInterval) {
+			ts.sweep()
+		}
+	}()
+	return ts, nil
+}
+
+// mint signs a token for req, minted by client.
+func (ts *tokenStore) mint(client string, req ActionRequest, ttl time.Duration) (raw, id string, expires time.Time, err error) {
+	if id, err = randomString(16); err != nil {
+		return "", "", time.Time{}, err
+	}
+	now := time.Now()
+	expires = now.Add(ttl).Truncate(time.Second)
+	t := jwt.New()
+	for k, v := range map[string]any{
+		jwt.IssuerKey:     tokenIssuer,
+		jwt.JwtIDKey:      id,
+		jwt.SubjectKey:    req.User,
+		jwt.AudienceKey:   req.Host,
+		jwt.IssuedAtKey:   now,
+		jwt.ExpirationKey: expires,
+		"account":         req.Account,
+		"duration":        req.Duration,
+		"reason":          req.Reason,
+		"client":          client,
+	} {
+		if err := t.Set(k, v); err != nil {
+			return "", "", time.Time{}, err
+		}
+	}
+	signed, err := jwt.Sign(t, jwa.HS256, ts.key)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return string(signed), id, expires, nil
+}
+
+// redeem verifies raw and marks it redeemed. It returns the unlock the
+// token grants.
+func (ts *tokenStore) redeem(raw string) (ActionRequest, error) {
+	t, err := jwt.Parse([]byte(raw),
+		jwt.WithVerify(jwa.HS256, ts.key),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(tokenIssuer),
+	)
+	if err != nil || len(t.Audience()) != 1 {
+		return ActionRequest{}, errTokenInvalid
+	}
+	claim := func(name string) string {
+		v, _ := t.Get(name)
+		s, _ := v.(string)
+		return s
+	}
+	req := ActionRequest{
+		User:     t.Subject(),
+		Action:   "unlock",
+		Account:  claim("account"),
+		Host:     t.Audience()[0],
+		Duration: claim("duration"),
+		Reason:   claim("reason"),
+		Client:   claim("client"),
+		TokenID:  t.JwtID(),
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.redeemed[req.TokenID]; ok {
+		return req, errTokenRedeemed
+	}
+	ts.redeemed[req.TokenID] = t.Expiration()
+	return req, nil
+}
+
+func (ts *tokenStore) sweep() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for id, expires := range ts.redeemed {
+		if time.Now().After(expires) {
+			delete(ts.redeemed, id)
+		}
+	}
+}
+
+// handleMintToken mints an unlock token: POST /tokens by a client with
+// mintTokens. The token is bound to the user, account, host and duration
+// and can be redeemed once before it expires.
+func (s *server) handleMintToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST allowed")
+		return
+	}
+	tokenConfig := s.current().config.UnlockTokens
+	if tokenConfig == nil {
+		writeError(w, http.StatusNotFound, codeInvalidRequest, "Unlock tokens are disabled")
+		return
+	}
+	client := s.apiClient(w, r)
+	if client == nil {
+		return
+	}
+	var tr tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&tr); err != nil || tr.User == "" || tr.Account == "" || tr.Duration == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "user, account and duration are required")
+		return
+	}
+	ip := s.clientIP(r)
+	h, ok := s.host(tr.Host)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Unknown host")
+		return
+	}
+	req := ActionRequest{User: tr.User, Action: "unlock", Account: tr.Account, Host: h.name, Duration: tr.Duration, Reason: tr.Reason}
+	if !client.MintTokens || !client.allowsIP(ip) || !client.allows(req) {
+		log.Printf("API client %s may not mint unlock tokens for %s as %s on %s from %s", client.Name, req.Account, req.User, req.Host, ip)
+		unlockTokens.WithLabelValues("forbidden").Inc()
+		writeError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	if d, err := time.ParseDuration(req.Duration); err != nil || d <= 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid duration")
+		return
+	}
+	if policy := s.approvals.policyFor(req); policy != nil {
+		if problem := policy.reasonProblem(req); problem != "" {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, problem)
+			return
+		}
+	}
+	maxTTL, _ := tokenConfig.maxTTL()
+	ttl := maxTTL
+	if tr.TTL != "" {
+		d, err := time.ParseDuration(tr.TTL)
+		if err != nil || d <= 0 || d > maxTTL {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("ttl must be positive and at most %v", maxTTL))
+			return
+		}
+		ttl = d
+	}
+
+	raw, id, expires, err := s.tokens.mint(client.Name, req, ttl)
+	if err != nil {
+		log.Printf("Error minting unlock token: %v", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal error")
+		return
+	}
+	req.Client, req.TokenID = client.Name, id
+	log.Printf("Minted unlock token %s for %s on %s (%s) via %s from %s, valid until %s",
+		id, req.Account, req.Host, req.Duration, client.Name, ip, expires.Format(time.RFC3339))
+	unlockTokens.WithLabelValues("minted").Inc()
+	notifyToken("token_minted", req, ip.String(), "")
+	writeJSON(w, http.StatusCreated, map[string]any{"token": raw, "id": id, "expires": expires})
+}
+
+// handleRedeemToken unlocks with a token: POST /tokens/redeem with
+// {"token": "..."}. The token replaces the second factor; the unlock is
+// audited under the token and its minting client, with no authenticated
+// user.
+func (s *server) handleRedeemToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST allowed")
+		return
+	}
+	if s.current().config.UnlockTokens == nil {
+		writeError(w, http.StatusNotFound, codeInvalidRequest, "Unlock tokens are disabled")
+		return
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request")
+		return
+	}
+	ip := s.clientIP(r)
+	req, err := s.tokens.redeem(body.Token)
+	if err != nil {
+		log.Printf("Rejected unlock token %s from %s: %v", req.TokenID, ip, err)
+		result := "invalid"
+		if errors.Is(err, errTokenRedeemed) {
+			result = "replayed"
+			notifyToken("token_replayed", req, ip.String(), err.Error())
+		}
+		unlockTokens.WithLabelValues(result).Inc()
+		writeError(w, http.StatusUnauthorized, codeInvalidToken, "Invalid or already redeemed token")
+		return
+	}
+	// The minting client must still be in good standing, and a reload may
+	// have narrowed what it is allowed since it minted the token
+	c := s.client(req.Client)
+	if c == nil || c.Revoked || !c.MintTokens || (c.Expires != nil && time.Now().After(*c.Expires)) {
+		log.Printf("Rejected unlock token %s from %s: client %s no longer mints tokens", req.TokenID, ip, req.Client)
+		unlockTokens.WithLabelValues("revoked").Inc()
+		writeError(w, http.StatusUnauthorized, codeInvalidToken, "Invalid or already redeemed token")
+		return
+	}
+	if !c.allowsIP(ip) || !c.allows(req) {
+		log.Printf("Rejected unlock token %s from %s: client %s may not unlock %s as %s on %s", req.TokenID, ip, c.Name, req.Account, req.User, req.Host)
+		unlockTokens.WithLabelValues("forbidden").Inc()
+		writeError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	log.Printf("Redeemed unlock token %s for %s on %s from %s", req.TokenID, req.Account, req.Host, ip)
+	unlockTokens.WithLabelValues("redeemed").Inc()
+	notifyToken("token_redeemed", req, ip.String(), "")
+	// No second factor is checked here, so the action is attributed to the
+	// token and its minting client rather than to an authenticated user
+	result, err := s.execute(ip, req, "")
+	s.writeResult(w, result, err)
+}
+
+// notifyToken fires the hooks for an unlock token event.
+func notifyToken(event string, req ActionRequest, ip, errMsg string) {
+	notifier.Load().Notify(sshlocker.Event{
+		Event:    event,
+		Host:     req.Host,
+		User:     req.Account,
+		Duration: req.Duration,
+		RemoteIP: ip,
+		AuthUser: req.User,
+		Reason:   req.Reason,
+		Client:   req.Client,
+		Error:    errMsg,
+		TokenID:  req.TokenID,
+	})
+}
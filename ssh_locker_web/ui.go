@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const uiCookie = "ssh_locker_ui"
+const uiSessionTTL = 30 * time.Minute
+
+//go:embed ui/*.html
+var uiFiles embed.FS
+
+// uiPages holds one template set per page, each combined with the layout.
+var uiPages = map[string]*template.Template{}
+
+func init() {
+	for _, page := range []string{"login", "dashboard", "challenge", "result"} {
+		uiPages[page] = template.Must(template.ParseFS(uiFiles, "ui/layout.html", "ui/"+page+".html"))
+	}
+}
+
+// uiSession is a browser logged in with an API client token. The client is
+// kept by name and looked up on every request, so a reload that removes,
+// revokes or expires it ends the session.
+type uiSession struct {
+	client  string
+	user    string
+	csrf    string
+	expires time.Time
+}
+
+// uiSessionStore maps UI cookies to logged in browsers.
+type uiSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]uiSession
+}
+
+func (st *uiSessionStore) add(s uiSession) (string, error) {
+	id, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	for k, v := range st.sessions {
+		if now.After(v.expires) {
+			delete(st.sessions, k)
+		}
+	}
+	st.sessions[id] = s
+	return id, nil
+}
+
+func (st *uiSessionStore) get(id string) (uiSession, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.sessions[id]
+	if !ok || time.Now().After(s.expires) {
+		delete(st.sessions, id)
+		return uiSession{}, false
+	}
+	return s, true
+}
+
+func (st *uiSessionStore) remove(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, id)
+}
+
+// accountRow is one line of the dashboard's status table.
+type accountRow struct {
+	Host    string
+	Account string
+	Status  string
+}
+
+// registerUI adds the browser UI handlers under /ui/.
+func (s *server) registerUI(mux *http.ServeMux) {
+	s.ui = &uiSessionStore{sessions: map[string]uiSession{}}
+	mux.HandleFunc("/ui/", s.handleDashboard)
+	mux.HandleFunc("/ui/login", s.limited(s.handleLogin))
+	mux.HandleFunc("/ui/logout", s.handleLogout)
+	mux.HandleFunc("/ui/action", s.limited(s.handleUIAction))
+	mux.HandleFunc("/ui/verify", s.limited(s.handleUIVerify))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/ui/", http.StatusFound)
+	})
+}
+
+func renderPage(w http.ResponseWriter, status int, page string, data map[string]any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := uiPages[page].ExecuteTemplate(w, "layout", data); err != nil {
+		log.Printf("Error rendering %s: %v", page, err)
+	}
+}
+
+// uiAuth returns the UI session of r and its API client, as currently
+// configured. For POST requests the form's CSRF token must match the
+// session.
+func (s *server) uiAuth(r *http.Request) (uiSession, *APIClient, bool) {
+	c, err := r.Cookie(uiCookie)
+	if err != nil {
+		return uiSession{}, nil, false
+	}
+	sess, ok := s.ui.get(c.Value)
+	if !ok {
+		return uiSession{}, nil, false
+	}
+	client := s.client(sess.client)
+	if client == nil {
+		err = errUnknownClient
+	} else {
+		err = client.active()
+	}
+	if err != nil {
+		log.Printf("Ended UI session of %s with API client %s: %v", sess.user, sess.client, err)
+		s.ui.remove(c.Value)
+		return uiSession{}, nil, false
+	}
+	if r.Method == http.MethodPost &&
+		subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(sess.csrf)) != 1 {
+		log.Printf("CSRF token mismatch for UI session of %s", sess.client)
+		return uiSession{}, nil, false
+	}
+	return sess, client, true
+}
+
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderPage(w, http.StatusOK, "login", nil)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := strings.TrimSpace(r.PostFormValue("user"))
+	r.Header.Set("X-Auth-Token", r.PostFormValue("token"))
+	client, err := authenticateClient(s.current().clients, r)
+	if err == nil && !client.allowsIP(s.clientIP(r)) {
+		err = errClientNetwork
+	}
+	if err != nil || user == "" {
+		if client != nil {
+			log.Printf("Rejected UI login of API client %s from %s: %v", client.Name, s.clientIP(r), err)
+		}
+		renderPage(w, http.StatusUnauthorized, "login", map[string]any{"Error": "Invalid user or token", "User": user})
+		return
+	}
+
+	csrf, err := randomString(32)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	sess := uiSession{client: client.Name, user: user, csrf: csrf, expires: time.Now().Add(uiSessionTTL)}
+	id, err := s.ui.add(sess)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     uiCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(uiSessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("UI login of %s with API client %s from %s", user, client.Name, s.clientIP(r))
+	http.Redirect(w, r, "/ui/", http.StatusSeeOther)
+}
+
+func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, _, ok := s.uiAuth(r); ok {
+		c, _ := r.Cookie(uiCookie)
+		s.ui.remove(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: uiCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/ui/login", http.StatusSeeOther)
+}
+
+// handleDashboard shows the lock state of the accounts and the action form.
+func (s *server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ui/" {
+		http.NotFound(w, r)
+		return
+	}
+	sess, client, ok := s.uiAuth(r)
+	if !ok {
+		http.Redirect(w, r, "/ui/login", http.StatusSeeOther)
+		return
+	}
+
+	var (
+		hosts    []string
+		accounts []string
+		rows     []accountRow
+		errs     []string
+	)
+	for _, h := range s.current().hosts {
+		if !client.allows(ActionRequest{User: sess.user, Action: "list", Host: h.name}) {
+			continue
+		}
+		hosts = append(hosts, h.name)
+		result, err := s.startAction(r, client, ActionRequest{User: sess.user, Action: "list", Host: h.name}, true)
+		if err != nil {
+			errs = append(errs, h.name+": "+err.Error())
+			continue
+		}
+		for _, row := range parseList(h.name, result.message) {
+			rows = append(rows, row)
+			if !slices.Contains(accounts, row.Account) {
+				accounts = append(accounts, row.Account)
+			}
+		}
+	}
+	var approvals []pendingApproval
+	for _, p := range s.approvals.list() {
+		if p.Request.User != sess.user && slices.Contains(p.policy.Approvers, sess.user) {
+			approvals = append(approvals, p)
+		}
+	}
+	renderPage(w, http.StatusOK, "dashboard", map[string]any{
+		"Approvals": approvals,
+		"User":      sess.user,
+		"Client":    sess.client,
+		"CSRF":      sess.csrf,
+		"Hosts":     hosts,
+		"Accounts":  accounts,
+		"Rows":      rows,
+		"Errors":    errs,
+	})
+}
+
+// parseList splits the reply of the list command ("u1: Locked; u2: ...").
+func parseList(host, reply string) []accountRow {
+	var rows []accountRow
+	for _, part := range strings.Split(reply, "; ") {
+		account, status, ok := strings.Cut(part, ": ")
+		if !ok {
+			continue
+		}
+		rows = append(rows, accountRow{Host: host, Account: account, Status: status})
+	}
+	return rows
+}
+
+func (s *server) handleUIAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sess, client, ok := s.uiAuth(r)
+	if !ok {
+		http.Redirect(w, r, "/ui/login", http.StatusSeeOther)
+		return
+	}
+
+	req := ActionRequest{
+		User:     sess.user,
+		Action:   r.PostFormValue("action"),
+		Account:  r.PostFormValue("account"),
+		Host:     r.PostFormValue("host"),
+		Approval: r.PostFormValue("approval"),
+		Code:     strings.TrimSpace(r.PostFormValue("code")),
+		Duration: strings.TrimSpace(r.PostFormValue("duration")),
+		Reason:   strings.TrimSpace(r.PostFormValue("reason")),
+	}
+	if req.Action == "lock" {
+		req.Duration = ""
+	}
+	result, err := s.startAction(r, client, req, true)
+	if err != nil || result.challenge == nil {
+		s.renderResult(w, result, err)
+		return
+	}
+	if result.challenge.RedirectURL != "" {
+		http.Redirect(w, r, result.challenge.RedirectURL, http.StatusSeeOther)
+		return
+	}
+
+	challenge, err := json.Marshal(result.challenge.Data)
+	if err != nil {
+		s.renderResult(w, result, err)
+		return
+	}
+	renderPage(w, http.StatusOK, "challenge", map[string]any{
+		"State":     result.state,
+		"CSRF":      sess.csrf,
+		"Backend":   s.current().auth.Name(),
+		"Request":   req,
+		"Challenge": template.JS(challenge),
+	})
+}
+
+// handleUIVerify answers a TOTP or WebAuthn challenge posted from the
+// challenge page.
+func (s *server) handleUIVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, _, ok := s.uiAuth(r); !ok {
+		http.Redirect(w, r, "/ui/login", http.StatusSeeOther)
+		return
+	}
+
+	resp := AuthResponse{State: r.PostFormValue("state"), Code: strings.TrimSpace(r.PostFormValue("code"))}
+	if assertion := r.PostFormValue("assertion"); assertion != "" {
+		resp.Assertion = &webauthnAssertion{}
+		if err := json.Unmarshal([]byte(assertion), resp.Assertion); err != nil {
+			s.renderResult(w, actionResult{}, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid request"))
+			return
+		}
+	}
+	_, result, err := s.resumeAction(r, resp)
+	s.renderResult(w, result, err)
+}
+
+// renderResult shows the outcome of an action started from the UI.
+func (s *server) renderResult(w http.ResponseWriter, result actionResult, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		message := "Internal error"
+		if apiErr, ok := err.(*apiError); ok {
+			status, message = apiErr.status, apiErr.message
+		}
+		renderPage(w, status, "result", map[string]any{"Error": message})
+		return
+	}
+	renderPage(w, http.StatusOK, "result", map[string]any{"Message": result.message, "Approval": result.approval})
+}
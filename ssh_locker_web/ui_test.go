@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUIAuthRechecksClient(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name    string
+		clients []*APIClient
+		ok      bool
+	}{
+		{"unchanged", []*APIClient{{Name: "ops"}}, true},
+		{"revoked", []*APIClient{{Name: "ops", Revoked: true}}, false},
+		{"expired", []*APIClient{{Name: "ops", Expires: &past}}, false},
+		{"removed", []*APIClient{{Name: "other"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{ui: &uiSessionStore{sessions: map[string]uiSession{}}}
+			s.settings.Store(&settings{clients: []*APIClient{{Name: "ops"}}})
+			id, err := s.ui.add(uiSession{client: "ops", user: "alice", csrf: "csrf", expires: time.Now().Add(uiSessionTTL)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A reload replaces the clients while the browser is logged in
+			s.settings.Store(&settings{clients: tt.clients})
+
+			r := httptest.NewRequest(http.MethodGet, "/ui/", nil)
+			r.AddCookie(&http.Cookie{Name: uiCookie, Value: id})
+			sess, client, ok := s.uiAuth(r)
+			if ok != tt.ok {
+				t.Fatalf("uiAuth ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && (sess.user != "alice" || client != tt.clients[0]) {
+				t.Errorf("uiAuth = %+v, %+v", sess, client)
+			}
+			if _, kept := s.ui.get(id); kept != tt.ok {
+				t.Errorf("session kept = %v, want %v", kept, tt.ok)
+			}
+		})
+	}
+}